@@ -0,0 +1,173 @@
+package amphtml
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/favclip/ampassador/amppb"
+	"github.com/favclip/html2html"
+)
+
+// fitChildTags validates the child tags of tag by child_tags of tagSpec.
+// the simple cases are repaired, stray texts are wrapped in the allowed child and disallowed children are unwrapped.
+func (conv *Converter) fitChildTags(tagSpec *amppb.TagSpec, tag html2html.Tag) {
+	childTagSpec := tagSpec.GetChildTags()
+	if childTagSpec == nil {
+		return
+	}
+
+	addError := func(code amppb.ValidationError_Code, token html2html.Token, format string, a ...interface{}) {
+		conv.addAMPError(&AMPError{
+			Type:                AMPValidatorError,
+			Code:                code,
+			token:               token,
+			validatorSourceSpec: tagSpec,
+			cause:               fmt.Errorf(format, a...),
+		})
+	}
+
+	allowedNames := childTagSpec.GetChildTagNameOneof()
+	if len(allowedNames) != 0 {
+		conv.repairChildTags(tagSpec, tag, allowedNames)
+	}
+
+	children := childTags(tag)
+
+	if firstNames := childTagSpec.GetFirstChildTagNameOneof(); len(firstNames) != 0 && len(children) != 0 {
+		if !containsTagName(firstNames, children[0].Name()) {
+			addError(amppb.ValidationError_DISALLOWED_FIRST_CHILD_TAG_NAME, children[0], "%s is not allowed as the first child of %s, allowed: %s", children[0].Name(), tag.Name(), strings.Join(firstNames, ", "))
+		}
+	}
+
+	if len(allowedNames) != 0 {
+		for _, child := range children {
+			if !containsTagName(allowedNames, child.Name()) {
+				addError(amppb.ValidationError_DISALLOWED_CHILD_TAG_NAME, child, "%s is not allowed as the child of %s, allowed: %s", child.Name(), tag.Name(), strings.Join(allowedNames, ", "))
+			}
+		}
+	}
+
+	if num := childTagSpec.GetMandatoryNumChildTags(); num != -1 && int(num) != len(children) {
+		addError(amppb.ValidationError_INCORRECT_NUM_CHILD_TAGS, tag, "%s must have %d child tags, but has %d", tag.Name(), num, len(children))
+	}
+}
+
+// repairChildTags unwraps the disallowed children which contain the allowed tags,
+// and wraps the stray texts and the other disallowed children in the first allowed tag.
+// the disallowed children are left as is if the allowed tag is a void element, they are reported by fitChildTags.
+func (conv *Converter) repairChildTags(tagSpec *amppb.TagSpec, tag html2html.Tag, allowedNames []string) {
+	wrapperName := strings.ToLower(allowedNames[0])
+	canWrap := !html2html.IsVoidElement(html2html.CreateElement(wrapperName))
+
+	var result []html2html.Token
+	var stray []html2html.Token
+	wrap := false
+	changed := false
+
+	flush := func() {
+		if wrap {
+			wrapper := html2html.CreateElement(wrapperName)
+			wrapper.AddChildTokens(stray...)
+			result = append(result, wrapper)
+			changed = true
+		} else {
+			result = append(result, stray...)
+		}
+		stray = nil
+		wrap = false
+	}
+
+	addWarning := func(child html2html.Tag, format string, a ...interface{}) {
+		conv.addAMPError(&AMPError{
+			Type:                AMPValidatorWarning,
+			Code:                amppb.ValidationError_DISALLOWED_CHILD_TAG_NAME,
+			token:               child,
+			validatorSourceSpec: tagSpec,
+			cause:               fmt.Errorf(format, a...),
+		})
+	}
+
+	queue := tag.Tokens()
+	for len(queue) != 0 {
+		token := queue[0]
+		queue = queue[1:]
+
+		if token.Type() != html2html.TypeTagToken {
+			if token.Type() == html2html.TypeTextToken && strings.TrimSpace(token.TextToken().Text()) != "" && canWrap {
+				wrap = true
+			}
+			stray = append(stray, token)
+			continue
+		}
+
+		child := token.Tag()
+		if containsTagName(allowedNames, child.Name()) {
+			flush()
+			result = append(result, token)
+			continue
+		}
+
+		hasAllowedChild := false
+		for _, grandChild := range childTags(child) {
+			if containsTagName(allowedNames, grandChild.Name()) {
+				hasAllowedChild = true
+				break
+			}
+		}
+		if hasAllowedChild {
+			// the contents are checked again in place of the child
+			queue = append(append([]html2html.Token{}, child.Tokens()...), queue...)
+			changed = true
+			addWarning(child, "%s is not allowed as the child of %s, unwrapped", child.Name(), tag.Name())
+			continue
+		}
+		if canWrap {
+			stray = append(stray, token)
+			wrap = true
+			addWarning(child, "%s is not allowed as the child of %s, wrapped in %s", child.Name(), tag.Name(), wrapperName)
+			continue
+		}
+
+		flush()
+		result = append(result, token)
+	}
+	flush()
+
+	if !changed {
+		return
+	}
+
+	setChildTokens(tag, result)
+}
+
+// childTags returns the child elements of tag.
+func childTags(tag html2html.Tag) []html2html.Tag {
+	var children []html2html.Tag
+	for _, token := range tag.Tokens() {
+		if token.Type() != html2html.TypeTagToken {
+			continue
+		}
+		children = append(children, token.Tag())
+	}
+
+	return children
+}
+
+// setChildTokens replaces the children of tag by tokens.
+// the old children are replaced by empty texts, html2html can't remove them.
+func setChildTokens(tag html2html.Tag, tokens []html2html.Token) {
+	for _, token := range tag.Tokens() {
+		tag.ReplateChildToken(token, html2html.CreateTextToken(""))
+	}
+	tag.AddChildTokens(tokens...)
+}
+
+func containsTagName(tagNames []string, name string) bool {
+	for _, tagName := range tagNames {
+		if strings.EqualFold(tagName, name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package amphtml
+
+import (
+	"testing"
+
+	"github.com/favclip/ampassador/amppb"
+	"github.com/favclip/html2html"
+)
+
+func TestFitChildTags(t *testing.T) {
+	str := func(s string) *string { return &s }
+	num := func(n int32) *int32 { return &n }
+
+	conv := &Converter{}
+	ulSpec := &amppb.TagSpec{
+		TagName:   str("UL"),
+		ChildTags: &amppb.ChildTagSpec{ChildTagNameOneof: []string{"LI"}},
+	}
+
+	// <ul>a<li>b</li><div><li>c</li></div><span>d</span></ul>
+	ul := html2html.CreateElement("ul")
+	li := html2html.CreateElement("li")
+	li.AddChildTokens(html2html.CreateTextToken("b"))
+	div := html2html.CreateElement("div")
+	divLi := html2html.CreateElement("li")
+	divLi.AddChildTokens(html2html.CreateTextToken("c"))
+	div.AddChildTokens(divLi)
+	span := html2html.CreateElement("span")
+	span.AddChildTokens(html2html.CreateTextToken("d"))
+	ul.AddChildTokens(html2html.CreateTextToken("a"), li, div, span)
+
+	conv.fitChildTags(ulSpec, ul)
+
+	children := childTags(ul)
+	if len(children) != 4 {
+		t.Fatal("unexpected", len(children))
+	}
+	for _, child := range children {
+		if child.Name() != "li" {
+			t.Error("unexpected", child.Name())
+		}
+	}
+	if len(childTags(children[3])) != 1 || childTags(children[3])[0].Name() != "span" {
+		t.Error("span must be wrapped in li")
+	}
+	for _, ampError := range conv.ampErrors {
+		if ampError.Type != AMPValidatorWarning {
+			t.Error("unexpected", ampError)
+		}
+	}
+
+	// the disallowed child is left as is if the allowed tag is a void element
+	conv.ampErrors = nil
+	brSpec := &amppb.TagSpec{
+		TagName:   str("DIV"),
+		ChildTags: &amppb.ChildTagSpec{ChildTagNameOneof: []string{"BR"}},
+	}
+	tag := html2html.CreateElement("div")
+	tag.AddChildTokens(html2html.CreateElement("p"))
+	conv.fitChildTags(brSpec, tag)
+	if len(conv.ampErrors) != 1 || conv.ampErrors[0].Code != amppb.ValidationError_DISALLOWED_CHILD_TAG_NAME {
+		t.Error("unexpected", conv.ampErrors)
+	}
+
+	submitSpec := &amppb.TagSpec{
+		TagName: str("DIV"),
+		ChildTags: &amppb.ChildTagSpec{
+			MandatoryNumChildTags:  num(1),
+			FirstChildTagNameOneof: []string{"TEMPLATE"},
+		},
+	}
+	specs := []struct {
+		children []string
+		expected amppb.ValidationError_Code
+	}{
+		{[]string{"template"}, amppb.ValidationError_UNKNOWN_CODE},
+		{[]string{}, amppb.ValidationError_INCORRECT_NUM_CHILD_TAGS},
+		{[]string{"template", "template"}, amppb.ValidationError_INCORRECT_NUM_CHILD_TAGS},
+		{[]string{"p"}, amppb.ValidationError_DISALLOWED_FIRST_CHILD_TAG_NAME},
+	}
+	for _, spec := range specs {
+		conv.ampErrors = nil
+		tag := html2html.CreateElement("div")
+		for _, name := range spec.children {
+			tag.AddChildTokens(html2html.CreateElement(name))
+		}
+
+		conv.fitChildTags(submitSpec, tag)
+
+		code := amppb.ValidationError_UNKNOWN_CODE
+		if len(conv.ampErrors) != 0 {
+			code = conv.ampErrors[0].Code
+		}
+		if code != spec.expected {
+			t.Error(spec.children, "unexpected", conv.ampErrors)
+		}
+	}
+}
@@ -2,26 +2,21 @@ package amphtml
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/favclip/ampassador/amppb"
 	"github.com/favclip/html2html"
-	"github.com/tdewolff/minify"
-	"github.com/tdewolff/minify/css"
 )
 
-type TagClassStyleMap map[string]map[string]string
-
 type Option interface {
 	implements(conv *Converter)
 }
@@ -50,6 +45,56 @@ func WithFileFetcher(fileFetcher FileFetcher) Option {
 	return &withFileFetcherOption{fileFetcher: fileFetcher}
 }
 
+type withHTTPClientOption struct {
+	httpClient *http.Client
+}
+
+func (o *withHTTPClientOption) implements(conv *Converter) {
+	conv.httpClient = o.httpClient
+}
+
+func WithHTTPClient(httpClient *http.Client) Option {
+	return &withHTTPClientOption{httpClient: httpClient}
+}
+
+type withMaxFetchBytesOption struct {
+	maxFetchBytes int64
+}
+
+func (o *withMaxFetchBytesOption) implements(conv *Converter) {
+	conv.maxFetchBytes = o.maxFetchBytes
+}
+
+func WithMaxFetchBytes(maxFetchBytes int64) Option {
+	return &withMaxFetchBytesOption{maxFetchBytes: maxFetchBytes}
+}
+
+type withFetchPolicyOption struct {
+	fetchPolicy *FetchPolicy
+}
+
+func (o *withFetchPolicyOption) implements(conv *Converter) {
+	conv.fetchPolicy = o.fetchPolicy
+}
+
+// WithFetchPolicy sets the policy of the default FileFetcher.
+// It is not applied to the FileFetcher given by WithFileFetcher, use FetchPolicy.Wrap for it.
+func WithFetchPolicy(fetchPolicy *FetchPolicy) Option {
+	return &withFetchPolicyOption{fetchPolicy: fetchPolicy}
+}
+
+type withAbsoluteURLOption struct {
+	absoluteURL bool
+}
+
+func (o *withAbsoluteURLOption) implements(conv *Converter) {
+	conv.absoluteURL = o.absoluteURL
+}
+
+func WithAbsoluteURL(absoluteURL bool) Option {
+	return &withAbsoluteURLOption{absoluteURL: absoluteURL}
+}
+
 type withAMPImageStatsFetcherOption struct {
 	ampImageStatsFetcher AMPImageStatsFetcher
 }
@@ -62,19 +107,119 @@ func WithAMPImageStatsFetcher(ampImageStatsFetcher AMPImageStatsFetcher) Option
 	return &withAMPImageStatsFetcherOption{ampImageStatsFetcher: ampImageStatsFetcher}
 }
 
+type withAssetSinkOption struct {
+	assetSink AssetSink
+}
+
+func (o *withAssetSinkOption) implements(conv *Converter) {
+	conv.assetSink = o.assetSink
+}
+
+func WithAssetSink(assetSink AssetSink) Option {
+	return &withAssetSinkOption{assetSink: assetSink}
+}
+
+type withMaxInlineImageBytesOption struct {
+	maxInlineImageBytes int
+}
+
+func (o *withMaxInlineImageBytesOption) implements(conv *Converter) {
+	conv.maxInlineImageBytes = o.maxInlineImageBytes
+}
+
+func WithMaxInlineImageBytes(maxInlineImageBytes int) Option {
+	return &withMaxInlineImageBytesOption{maxInlineImageBytes: maxInlineImageBytes}
+}
+
+type withImagePlaceholderOption struct {
+	imagePlaceholderMode ImagePlaceholderMode
+}
+
+func (o *withImagePlaceholderOption) implements(conv *Converter) {
+	conv.imagePlaceholderMode = o.imagePlaceholderMode
+}
+
+func WithImagePlaceholder(imagePlaceholderMode ImagePlaceholderMode) Option {
+	return &withImagePlaceholderOption{imagePlaceholderMode: imagePlaceholderMode}
+}
+
+type withDropPrintStyleSheetsOption struct {
+	dropPrintStyleSheets bool
+}
+
+func (o *withDropPrintStyleSheetsOption) implements(conv *Converter) {
+	conv.dropPrintStyleSheets = o.dropPrintStyleSheets
+}
+
+func WithDropPrintStyleSheets(dropPrintStyleSheets bool) Option {
+	return &withDropPrintStyleSheetsOption{dropPrintStyleSheets: dropPrintStyleSheets}
+}
+
+type withStyleClassModeOption struct {
+	styleClassMode StyleClassMode
+}
+
+func (o *withStyleClassModeOption) implements(conv *Converter) {
+	conv.styleClassMode = o.styleClassMode
+}
+
+func WithStyleClassMode(styleClassMode StyleClassMode) Option {
+	return &withStyleClassModeOption{styleClassMode: styleClassMode}
+}
+
+type withStyleClassPrefixOption struct {
+	styleClassPrefix string
+}
+
+func (o *withStyleClassPrefixOption) implements(conv *Converter) {
+	conv.styleClassPrefix = o.styleClassPrefix
+}
+
+func WithStyleClassPrefix(styleClassPrefix string) Option {
+	return &withStyleClassPrefixOption{styleClassPrefix: styleClassPrefix}
+}
+
+type withLayoutPolicyOption struct {
+	layoutPolicy LayoutPolicy
+}
+
+func (o *withLayoutPolicyOption) implements(conv *Converter) {
+	conv.layoutPolicy = o.layoutPolicy
+}
+
+func WithLayoutPolicy(layoutPolicy LayoutPolicy) Option {
+	return &withLayoutPolicyOption{layoutPolicy: layoutPolicy}
+}
+
 type Converter struct {
 	debug bool
 
 	canonicalURL         string
+	absoluteURL          bool
+	httpClient           *http.Client
+	fetchPolicy          *FetchPolicy
+	maxFetchBytes        int64
 	fileFetcher          FileFetcher
 	ampImageStatsFetcher AMPImageStatsFetcher
+	assetSink            AssetSink
+	maxInlineImageBytes  int
+	imagePlaceholderMode ImagePlaceholderMode
+	dropPrintStyleSheets bool
+	styleClassMode       StyleClassMode
+	styleClassPrefix     string
+	layoutPolicy         LayoutPolicy
 
 	ampValidatorRules *wrappedRules
 
-	requires     map[string]*amppb.TagSpec
+	baseURL *url.URL
+
+	requires     map[string][]*amppb.TagSpec
 	satisfied    map[string]*amppb.TagSpec
 	tagSpecReady map[*amppb.TagSpec][]html2html.Tag
 
+	// the classes made from style attrs which have display: flex
+	flexContainerClasses map[string]bool
+
 	ampErrors AMPErrors
 }
 
@@ -89,12 +234,17 @@ func NewConverter(opts ...Option) (*Converter, error) {
 		return nil, err
 	}
 	conv := &Converter{
-		debug:             true,
-		canonicalURL:      "/",
-		ampValidatorRules: rules,
-		requires:          make(map[string]*amppb.TagSpec),
-		satisfied:         make(map[string]*amppb.TagSpec),
-		tagSpecReady:      make(map[*amppb.TagSpec][]html2html.Tag),
+		debug:               true,
+		canonicalURL:        "/",
+		maxFetchBytes:       defaultMaxFetchBytes,
+		maxInlineImageBytes: 4096,
+		styleClassPrefix:    "h2a-",
+		ampValidatorRules:   rules,
+		requires:            make(map[string][]*amppb.TagSpec),
+		satisfied:           make(map[string]*amppb.TagSpec),
+		tagSpecReady:        make(map[*amppb.TagSpec][]html2html.Tag),
+
+		flexContainerClasses: make(map[string]bool),
 	}
 	for _, opt := range opts {
 		opt.implements(conv)
@@ -109,22 +259,18 @@ func NewConverter(opts ...Option) (*Converter, error) {
 			return nil, errors.New("FileFetcher is required")
 		}
 
-		conv.fileFetcher = func(targetURL *url.URL) (io.ReadCloser, error) {
-			if targetURL.Host == "" {
-				targetURL.Host = canonicalURL.Host
-
-				if !strings.HasPrefix(targetURL.Path, "/") {
-					// TODO base url?
-					targetURL.Path = path.Join(canonicalURL.Path, targetURL.Path)
-				}
-			}
+		fetchPolicy := conv.fetchPolicy
+		if fetchPolicy == nil {
+			fetchPolicy = DefaultFetchPolicy()
+		}
 
-			resp, err := http.Get(targetURL.String())
-			if err != nil {
-				return nil, err
-			}
-			return resp.Body, nil
+		// targetURL is already resolved against the document base URL
+		httpClient, err := fetchPolicy.HTTPClient(conv.httpClient)
+		if err != nil {
+			return nil, err
 		}
+		httpFileFetcher := NewHTTPFileFetcher(httpClient, conv.maxFetchBytes)
+		conv.fileFetcher = fetchPolicy.Wrap(httpFileFetcher)
 	}
 	if conv.ampImageStatsFetcher == nil {
 		conv.ampImageStatsFetcher = &ampImageStatsFetcherImpl{fileFetcher: conv.fileFetcher}
@@ -133,9 +279,16 @@ func NewConverter(opts ...Option) (*Converter, error) {
 	return conv, nil
 }
 
-func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagClassStyleMap, error) {
-	styleMap := make(TagClassStyleMap)
-	var linkCSSContents []string
+func (conv *Converter) ReplaceToAMPTag(ctx context.Context, tag html2html.Tag) (html2html.Tag, StyleSheets, error) {
+	baseURL, err := conv.documentBaseURL(tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	conv.baseURL = baseURL
+
+	// in document order
+	var styleSheets StyleSheets
+	styleClasses := make(map[string]bool)
 
 	type Modifier func(tag html2html.Tag) (html2html.Token, error)
 
@@ -159,6 +312,10 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 
 	var modifier Modifier
 	modifier = func(tag html2html.Tag) (html2html.Token, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		if tag.IsDocumentRoot() {
 			err := childModifier(modifier, tag)
 			if err != nil {
@@ -170,7 +327,10 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 		processed := false
 
 		// extract css informations
-		if isLinkStyleSheet(tag) {
+		if conv.isFontProviderStyleSheet(tag) {
+			// whitelisted font providers are allowed as <link>. the response depends on the user agent, don't inline it.
+			processed = true
+		} else if isLinkStyleSheet(tag) {
 			hrefAttr := tag.GetAttr("href")
 			if hrefAttr == nil {
 				if conv.debug {
@@ -178,16 +338,32 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 				}
 				return html2html.CreateTextToken(""), nil
 			}
-			styleSheetURL, err := url.Parse(hrefAttr.Value)
+			media, ok := conv.styleSheetMedia(tag)
+			if !ok {
+				if conv.debug {
+					return html2html.CreateCommentToken(fmt.Sprintf(" removed: link tag %s for media %s ", hrefAttr.Value, tag.GetAttr("media").Value)), nil
+				}
+				return html2html.CreateTextToken(""), nil
+			}
+			styleSheetURL, err := conv.resolveURL(hrefAttr.Value)
 			if err != nil {
 				return nil, err
 			}
-			f, err := conv.fileFetcher(styleSheetURL)
-			if err != nil {
+			cssContent, err := conv.fetchStyleSheet(ctx, styleSheetURL)
+			if isFetchBlocked(err) {
+				conv.addAMPError(&AMPError{
+					Type:  AMPFetchBlocked,
+					token: tag,
+					cause: err,
+				})
+				if conv.debug {
+					return html2html.CreateCommentToken(fmt.Sprintf(" removed: link tag %s is blocked ", hrefAttr.Value)), nil
+				}
+				return html2html.CreateTextToken(""), nil
+			} else if err != nil {
 				return nil, err
 			}
-			defer f.Close()
-			b, err := ioutil.ReadAll(f)
+			cssContent, err = conv.inlineCSSImports(ctx, cssContent, styleSheetURL, []string{styleSheetURL.String()})
 			if err != nil {
 				return nil, err
 			}
@@ -196,8 +372,12 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 			if conv.debug {
 				content += fmt.Sprintf("/* from %s */\n", hrefAttr.Value)
 			}
-			content += string(b)
-			linkCSSContents = append(linkCSSContents, content)
+			content += wrapCSSMedia(cssContent, media)
+			styleSheets = append(styleSheets, &StyleSheet{
+				Type:    StyleSheetLink,
+				Source:  hrefAttr.Value,
+				Content: content,
+			})
 
 			if conv.debug {
 				return html2html.CreateCommentToken(fmt.Sprintf(" replaced: link tag %s ", hrefAttr.Value)), nil
@@ -205,14 +385,34 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 			return html2html.CreateTextToken(""), nil
 		}
 		if isEmbedStyleSheet(tag) {
-			buf := bytes.NewBufferString("")
-			if conv.debug {
-				buf.WriteString("/* from style tag */\n")
+			media, ok := conv.styleSheetMedia(tag)
+			if !ok {
+				if conv.debug {
+					return html2html.CreateCommentToken(fmt.Sprintf(" removed: style tag for media %s ", tag.GetAttr("media").Value)), nil
+				}
+				return html2html.CreateTextToken(""), nil
 			}
+
+			buf := bytes.NewBufferString("")
 			for _, token := range tag.Tokens() {
 				token.BuildHTML(buf)
 			}
-			linkCSSContents = append(linkCSSContents, buf.String())
+			// url() in the style tag is relative to the document base URL, AMP allows only <base href="/"> and caches serve from another origin
+			cssContent := rebaseCSSURLs(buf.String(), conv.baseURL)
+			cssContent, err := conv.inlineCSSImports(ctx, cssContent, conv.baseURL, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			var content string
+			if conv.debug {
+				content += "/* from style tag */\n"
+			}
+			content += wrapCSSMedia(cssContent, media)
+			styleSheets = append(styleSheets, &StyleSheet{
+				Type:    StyleSheetEmbed,
+				Content: content,
+			})
 
 			if conv.debug {
 				return html2html.CreateCommentToken(" replaced: style tag "), nil
@@ -226,10 +426,17 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 				continue
 			}
 
-			altTag, err := ampTag.Modifier(conv, ampTag, tag)
+			altTag, err := ampTag.Modifier(ctx, conv, ampTag, tag)
 			if err != nil {
 				return nil, err
 			}
+			if altTag == nil {
+				// removed by the modifier
+				if conv.debug {
+					return html2html.CreateCommentToken(fmt.Sprintf(" removed: %s tag ", tag.Name())), nil
+				}
+				return html2html.CreateTextToken(""), nil
+			}
 
 			tag = altTag
 			processed = true
@@ -302,15 +509,18 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 		}
 
 		if styleAttr != "" {
-			h := sha1.New()
-			h.Write([]byte(styleAttr))
-			sha1Hash := fmt.Sprintf("%x", h.Sum(nil))
-			sha1Hash = sha1Hash[0:10]
-			className := "h2a-" + tag.Name() + "-" + sha1Hash
-			if styleMap[tag.Name()] == nil {
-				styleMap[tag.Name()] = make(map[string]string)
+			className, rule := conv.styleAttrClass(tag.Name(), styleAttr)
+			if !styleClasses[className] {
+				styleClasses[className] = true
+				if isFlexContainerStyle(styleAttr) {
+					conv.flexContainerClasses[className] = true
+				}
+				styleSheets = append(styleSheets, &StyleSheet{
+					Type:    StyleSheetAttr,
+					Source:  className,
+					Content: rule,
+				})
 			}
-			styleMap[tag.Name()][className] = styleAttr
 
 			if classAttr != "" {
 				classAttr += " "
@@ -322,7 +532,7 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 		}
 
 		// check attr validity
-		for _, tagSpec := range conv.tagMatchedSpecs(tag) {
+		if tagSpec := conv.dispatchTagSpec(tag); tagSpec != nil {
 			// NOTE don't check tag specs. It will be check in later.
 			// but checking up the attr specs...
 
@@ -332,10 +542,16 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 					return nil, err
 				}
 			}
+			err := conv.fitMandatoryOneof(tag, tagSpec, true)
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		// TODO remove unnecessary attr
 
+		conv.absolutizeURLAttrs(tag)
+
 		if processed {
 			err := childModifier(modifier, tag)
 			if err != nil {
@@ -353,13 +569,6 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 		return nil, nil, err
 	}
 
-	if len(linkCSSContents) != 0 {
-		if styleMap[""] == nil {
-			styleMap[""] = make(map[string]string)
-		}
-		styleMap[""][""] = strings.Join(linkCSSContents, "\n")
-	}
-
 	if altToken != nil {
 		if altToken.Type() != html2html.TypeTagToken {
 			return nil, nil, errors.New("unexpected state")
@@ -367,13 +576,23 @@ func (conv *Converter) ReplaceToAMPTag(tag html2html.Tag) (html2html.Tag, TagCla
 		tag = altToken.Tag()
 	}
 
-	return tag, styleMap, nil
+	return tag, styleSheets, nil
+}
+
+// the values of the attrs required by AttrTriggerSpec. e.g. on="tap:..." requires role and tabindex for accessibility.
+var triggerAttrDefaults = map[string]string{
+	"role":     "button",
+	"tabindex": "0",
 }
 
 func (conv *Converter) replaceTagAttr(tag html2html.Tag, tagSpec *amppb.TagSpec, attrSpec *amppb.AttrSpec) error {
 	if attrSpec.GetName() == "" {
 		return errors.New("unknown attrSpec name")
 	}
+	if attrSpec.GetImplicit() {
+		// implied by the element itself, e.g. role of <button>. it is neither required nor fixed.
+		return nil
+	}
 
 	for _, altName := range attrSpec.GetAlternativeNames() {
 		if tag.HasAttr(altName) {
@@ -398,8 +617,6 @@ func (conv *Converter) replaceTagAttr(tag html2html.Tag, tagSpec *amppb.TagSpec,
 		}
 	}
 
-	// TODO support mandatory_oneof
-
 	// remove first
 	if attrSpec.ValueRegex != nil && tag.HasAttr(attrSpec.GetName()) {
 		re, err := regexp.Compile(attrSpec.GetValueRegex())
@@ -439,7 +656,7 @@ func (conv *Converter) replaceTagAttr(tag html2html.Tag, tagSpec *amppb.TagSpec,
 			return err
 		}
 
-		if !re.MatchString(tag.GetAttr(attrSpec.GetName()).Value) {
+		if re.MatchString(tag.GetAttr(attrSpec.GetName()).Value) {
 			tag.RemoveAttr(attrSpec.GetName())
 
 			conv.addAMPError(&AMPError{
@@ -544,7 +761,36 @@ func (conv *Converter) replaceTagAttr(tag html2html.Tag, tagSpec *amppb.TagSpec,
 		}
 	}
 
-	// TODO support Trigger
+	if attrSpec.Trigger != nil && tag.HasAttr(attrSpec.GetName()) {
+		trigger := attrSpec.GetTrigger()
+		triggered := true
+		if trigger.IfValueRegex != nil {
+			re, err := regexp.Compile("^(?:" + trigger.GetIfValueRegex() + ")$")
+			if err != nil {
+				return err
+			}
+			triggered = re.MatchString(tag.GetAttr(attrSpec.GetName()).Value)
+		}
+
+		if triggered {
+			for _, required := range trigger.GetAlsoRequiresAttr() {
+				if tag.HasAttr(required) || conv.ampValidatorRules.isImplicitAttr(tagSpec, required) {
+					continue
+				}
+				if value, ok := triggerAttrDefaults[required]; ok {
+					tag.AddAttr(required, value)
+					continue
+				}
+				conv.addAMPError(&AMPError{
+					Type:                AMPValidatorError,
+					Code:                amppb.ValidationError_ATTR_REQUIRED_BUT_MISSING,
+					token:               tag,
+					validatorSourceSpec: tagSpec,
+					cause:               fmt.Errorf("%s is required by %s", required, attrSpec.GetName()),
+				})
+			}
+		}
+	}
 
 	if attrSpec.Deprecation != nil {
 		conv.addAMPError(&AMPError{
@@ -555,10 +801,70 @@ func (conv *Converter) replaceTagAttr(tag html2html.Tag, tagSpec *amppb.TagSpec,
 		})
 	}
 
-	// TODO support DispatchKey
-	// 親タグと同名のタグが既にあったらエラーにする的な…？
+	return nil
+}
+
+// fitMandatoryOneof checks that just one attr in each mandatory_oneof group is present.
+// when repair is true, the other attrs are removed, and the missing attr is taken from data-* attr. e.g. data-src of lazy loading.
+// otherwise the violations are reported.
+func (conv *Converter) fitMandatoryOneof(tag html2html.Tag, tagSpec *amppb.TagSpec, repair bool) error {
+	for _, group := range mandatoryOneofGroups(conv.ampValidatorRules.getAttrSpecs(tagSpec)) {
+		var present []string
+		for _, attrSpec := range group {
+			if name, ok := presentAttrName(tag, attrSpec); ok {
+				present = append(present, name)
+			}
+		}
+
+		if len(present) == 0 && repair {
+			for _, attrSpec := range group {
+				if attr := tag.GetAttr("data-" + attrSpec.GetName()); attr != nil {
+					tag.RemoveAttr(attr.Key)
+					tag.AddAttr(attrSpec.GetName(), attr.Value)
+					// the value is not checked yet, it may be removed here
+					err := conv.replaceTagAttr(tag, tagSpec, attrSpec)
+					if err != nil {
+						return err
+					}
+					if tag.HasAttr(attrSpec.GetName()) {
+						present = append(present, attrSpec.GetName())
+					}
+					break
+				}
+			}
+		}
 
-	// TODO support Implicit
+		switch {
+		case len(present) == 0 && !repair:
+			conv.addAMPError(&AMPError{
+				Type:                AMPValidatorError,
+				Code:                amppb.ValidationError_MANDATORY_ONEOF_ATTR_MISSING,
+				token:               tag,
+				validatorSourceSpec: tagSpec,
+				cause:               fmt.Errorf("one of %s is required", group[0].GetMandatoryOneof()),
+			})
+		case 1 < len(present) && repair:
+			// the first one in the spec is preferred
+			for _, name := range present[1:] {
+				tag.RemoveAttr(name)
+			}
+			conv.addAMPError(&AMPError{
+				Type:                AMPRemoveAttr,
+				Code:                amppb.ValidationError_MUTUALLY_EXCLUSIVE_ATTRS,
+				token:               tag,
+				validatorSourceSpec: tagSpec,
+				cause:               fmt.Errorf("%s are mutually exclusive, %s is removed", group[0].GetMandatoryOneof(), strings.Join(present[1:], ", ")),
+			})
+		case 1 < len(present):
+			conv.addAMPError(&AMPError{
+				Type:                AMPValidatorError,
+				Code:                amppb.ValidationError_MUTUALLY_EXCLUSIVE_ATTRS,
+				token:               tag,
+				validatorSourceSpec: tagSpec,
+				cause:               fmt.Errorf("%s are mutually exclusive", group[0].GetMandatoryOneof()),
+			})
+		}
+	}
 
 	return nil
 }
@@ -598,52 +904,19 @@ func (conv *Converter) MakeUpRequiredTags(tag html2html.Tag) html2html.Tag {
 	return rootTag
 }
 
-func (conv *Converter) StyleToAMPCustomTag(styleMap TagClassStyleMap) (html2html.Token, error) {
-	if len(styleMap) == 0 {
+func (conv *Converter) StyleToAMPCustomTag(rootTag html2html.Tag, styleSheets StyleSheets) (html2html.Token, error) {
+	if len(styleSheets) == 0 {
 		return html2html.CreateTextToken(""), nil
 	}
 
-	buf := bytes.NewBufferString("")
-	for tagName, classStyleMap := range styleMap {
-		for className, style := range classStyleMap {
-			if tagName == "" && className == "" {
-				// from link tag
-				buf.WriteString(style)
-				buf.WriteString("\n")
-				continue
-			}
-			if tagName != "" {
-				buf.WriteString(tagName)
-			}
-			if className != "" {
-				buf.WriteString(".")
-				buf.WriteString(className)
-				buf.WriteString("{")
-				buf.WriteString(style)
-				buf.WriteString("}\n")
-			}
-		}
-	}
-
 	style := html2html.CreateElement("style")
 	style.AddAttr("amp-custom", "")
 
-	styleString := buf.String()
-
-	if 50000 < buf.Len() {
-		m := minify.New()
-		m.AddFunc("text/css", css.Minify)
-		cssStr, err := m.String("text/css", styleString)
-		if err != nil {
-			return nil, err
-		}
-		if 50000 < len(cssStr) {
-			// TODO AMP error
-		}
-		style.AddChildTokens(html2html.CreateTextToken(cssStr))
-	} else {
-		style.AddChildTokens(html2html.CreateTextToken(buf.String()))
+	styleString, err := conv.buildAMPCustomCSS(rootTag, styleSheets)
+	if err != nil {
+		return nil, err
 	}
+	style.AddChildTokens(html2html.CreateTextToken(styleString))
 
 	return style, nil
 }
@@ -659,21 +932,188 @@ func (conv *Converter) FittingToAMPSpecs(rootTag html2html.Tag) error {
 	return nil
 }
 
-func (conv *Converter) FittingToAMPSpec(tagSpec *amppb.TagSpec, rootTag html2html.Tag) error {
-	if htmlFormats := tagSpec.GetHtmlFormat(); len(htmlFormats) != 0 {
-		found := false
-		for _, htmlFormat := range htmlFormats {
-			if htmlFormat == conv.ampValidatorRules.targetHTMLFormat {
-				found = true
-				break
+// the condition satisfied by the script of an extension, e.g. "amp-form extension .js script".
+var extensionScriptConditionRegexp = regexp.MustCompile(`^(amp-[a-z0-9-]+) extension \.js script$`)
+
+// addRequires records that tagSpec requires condition. each spec is recorded once.
+func (conv *Converter) addRequires(condition string, tagSpec *amppb.TagSpec) {
+	for _, v := range conv.requires[condition] {
+		if v == tagSpec {
+			return
+		}
+	}
+	conv.requires[condition] = append(conv.requires[condition], tagSpec)
+}
+
+// verifyRequires reports the conditions which are required by some tags, but no tag satisfies.
+// the missing extension scripts are inserted into head.
+func (conv *Converter) verifyRequires(rootTag html2html.Tag) {
+	conditions := make([]string, 0, len(conv.requires))
+	for condition := range conv.requires {
+		conditions = append(conditions, condition)
+	}
+	sort.Strings(conditions)
+
+	for _, condition := range conditions {
+		if _, ok := conv.satisfied[condition]; ok {
+			continue
+		}
+		if satisfiedSpec := conv.findSatisfiedSpec(condition, rootTag); satisfiedSpec != nil {
+			// the tag is created after the spec is fitted, e.g. noscript > style[amp-boilerplate]
+			conv.satisfied[condition] = satisfiedSpec
+			continue
+		}
+		tagSpecs := conv.requires[condition]
+		specNames := make([]string, 0, len(tagSpecs))
+		for _, tagSpec := range tagSpecs {
+			specNames = append(specNames, tagSpec.GetSpecName())
+		}
+
+		if m := extensionScriptConditionRegexp.FindStringSubmatch(condition); m != nil {
+			if heads := rootTag.GetElementsByTagName("head"); len(heads) != 0 {
+				if hasExtensionScript(heads[0], m[1]) {
+					// the rules don't know the script, but it is there
+					conv.satisfied[condition] = tagSpecs[0]
+					continue
+				}
+
+				if src := conv.ampValidatorRules.extensionScriptURL(m[1]); src != "" {
+					script := html2html.CreateElement("script")
+					script.AddAttr("async", "")
+					script.AddAttr("custom-element", m[1])
+					script.AddAttr("src", src)
+					heads[0].AddChildTokens(script)
+
+					conv.satisfied[condition] = tagSpecs[0]
+					conv.addAMPError(&AMPError{
+						Type:                AMPValidatorWarning,
+						Code:                amppb.ValidationError_TAG_REQUIRED_BY_MISSING,
+						token:               script,
+						validatorSourceSpec: tagSpecs[0],
+						cause:               fmt.Errorf("%s is required by %s, inserted", condition, strings.Join(specNames, ", ")),
+					})
+					continue
+				}
 			}
 		}
-		if !found {
-			return nil
+
+		conv.addAMPError(&AMPError{
+			Type:                AMPValidatorError,
+			Code:                amppb.ValidationError_TAG_REQUIRED_BY_MISSING,
+			token:               rootTag,
+			validatorSourceSpec: tagSpecs[0],
+			cause:               fmt.Errorf("%s is required by %s", condition, strings.Join(specNames, ", ")),
+		})
+	}
+}
+
+// hasExtensionScript reports whether head has the script of the extension name.
+func hasExtensionScript(head html2html.Tag, name string) bool {
+	for _, script := range head.GetElementsByTagName("script") {
+		if script.HasAttrValue("custom-element", name) || script.HasAttrValue("custom-template", name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// alternativeMatchedTags returns the tags which match to any TagSpec of the mandatory_alternatives group.
+func (conv *Converter) alternativeMatchedTags(name string, rootTag html2html.Tag) []html2html.Tag {
+	var resultList []html2html.Tag
+	for _, tagSpec := range conv.ampValidatorRules.mandatoryAlternatives(name) {
+		for _, tag := range conv.specMatchedTags(tagSpec, rootTag) {
+			// the old variants are distinguished by the content only
+			if !isCdataMatch(tagSpec, tag) {
+				continue
+			}
+			resultList = append(resultList, tag)
+		}
+	}
+
+	return resultList
+}
+
+// verifyMandatoryAlternatives reports the mandatory_alternatives groups which no tag matches.
+func (conv *Converter) verifyMandatoryAlternatives(rootTag html2html.Tag) {
+	var names []string
+	found := make(map[string]bool)
+	for _, tagSpec := range conv.ampValidatorRules.rules.GetTags() {
+		if tagSpec.MandatoryAlternatives == nil || !conv.ampValidatorRules.isTargetHTMLFormat(tagSpec) {
+			continue
+		}
+		if name := tagSpec.GetMandatoryAlternatives(); !found[name] {
+			found[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(conv.alternativeMatchedTags(name, rootTag)) != 0 {
+			continue
+		}
+
+		conv.addAMPError(&AMPError{
+			Type:                AMPValidatorError,
+			Code:                amppb.ValidationError_MANDATORY_TAG_MISSING,
+			token:               rootTag,
+			validatorSourceSpec: preferredAlternative(name, conv.ampValidatorRules.mandatoryAlternatives(name)),
+			cause:               fmt.Errorf("one of %s is missing", name),
+		})
+	}
+}
+
+// isCdataMatch reports whether the content of tag matches to cdata_regex of tagSpec.
+func isCdataMatch(tagSpec *amppb.TagSpec, tag html2html.Tag) bool {
+	cdata := tagSpec.GetCdata()
+	if cdata == nil || cdata.CdataRegex == nil {
+		return true
+	}
+
+	re, err := regexp.Compile("^(?:" + cdata.GetCdataRegex() + ")$")
+	if err != nil {
+		return false
+	}
+
+	buf := bytes.NewBufferString("")
+	for _, token := range tag.Tokens() {
+		token.BuildHTML(buf)
+	}
+
+	return re.MatchString(buf.String())
+}
+
+// findSatisfiedSpec returns the TagSpec which satisfies the condition and matches to some tags.
+func (conv *Converter) findSatisfiedSpec(condition string, rootTag html2html.Tag) *amppb.TagSpec {
+	for _, tagSpec := range conv.ampValidatorRules.rules.GetTags() {
+		if !conv.ampValidatorRules.isTargetHTMLFormat(tagSpec) {
+			continue
+		}
+		for _, satisfied := range tagSpec.GetSatisfies() {
+			if satisfied == condition && len(conv.specMatchedTags(tagSpec, rootTag)) != 0 {
+				return tagSpec
+			}
 		}
 	}
 
-	if tagSpec.GetMandatory() || (tagSpec.MandatoryAlternatives != nil && tagSpec.GetMandatoryAlternatives() == tagSpec.GetSpecName()) {
+	return nil
+}
+
+func (conv *Converter) FittingToAMPSpec(tagSpec *amppb.TagSpec, rootTag html2html.Tag) error {
+	if !conv.ampValidatorRules.isTargetHTMLFormat(tagSpec) {
+		return nil
+	}
+
+	mandatory := tagSpec.GetMandatory()
+	if tagSpec.MandatoryAlternatives != nil {
+		// only the preferred one is created, when none of the alternatives is present
+		name := tagSpec.GetMandatoryAlternatives()
+		preferred := preferredAlternative(name, conv.ampValidatorRules.mandatoryAlternatives(name))
+		mandatory = preferred == tagSpec && len(conv.alternativeMatchedTags(name, rootTag)) == 0
+	}
+
+	if mandatory {
 		if v := tagSpec.GetTagName(); v == "!DOCTYPE" {
 			doctypeToken := rootTag.Tokens()[0]
 			if doctypeToken.Type() != html2html.TypeDoctypeToken {
@@ -706,9 +1146,17 @@ func (conv *Converter) FittingToAMPSpec(tagSpec *amppb.TagSpec, rootTag html2htm
 		} else if len(matchTags) == 0 {
 			token := conv.tagSpecToToken(tagSpec)
 			conv.insertTagByTagSpec(rootTag, tagSpec, token)
-		}
 
-		// TODO support MandatoryAlternatives
+			if tagSpec.MandatoryAlternatives != nil {
+				conv.addAMPError(&AMPError{
+					Type:                AMPValidatorWarning,
+					Code:                amppb.ValidationError_MANDATORY_TAG_MISSING,
+					token:               token,
+					validatorSourceSpec: tagSpec,
+					cause:               fmt.Errorf("one of %s is missing, %s is created", tagSpec.GetMandatoryAlternatives(), tagSpec.GetSpecName()),
+				})
+			}
+		}
 	}
 
 	matchTags := conv.specMatchedTags(tagSpec, rootTag)
@@ -760,13 +1208,18 @@ func (conv *Converter) FittingToAMPSpec(tagSpec *amppb.TagSpec, rootTag html2htm
 				})
 			}
 
-			// TODO support MandatoryOneof, Value, ValueCasei, ValueRegex, ValueRegexCasei, ValueUrl, ValueProperties, BlacklistedValueRegex
+			// TODO support Value, ValueCasei, ValueRegex, ValueRegexCasei, ValueUrl, ValueProperties, BlacklistedValueRegex
 
 			// TODO Cdata
-			// TODO ChildTags
-			// TODO AmpLayout
 		}
 
+		err := conv.fitMandatoryOneof(tag, tagSpec, false)
+		if err != nil {
+			return err
+		}
+		conv.fitAMPLayout(tagSpec, tag)
+		conv.fitChildTags(tagSpec, tag)
+
 		findAttrSpec := func(attr *html2html.Attr) *amppb.AttrSpec {
 			for _, attrSpec := range conv.ampValidatorRules.getAttrSpecs(tagSpec) {
 				if attrSpec.GetName() == attr.Key {
@@ -795,7 +1248,7 @@ func (conv *Converter) FittingToAMPSpec(tagSpec *amppb.TagSpec, rootTag html2htm
 		}
 
 		for _, required := range tagSpec.GetRequires() {
-			conv.requires[required] = tagSpec
+			conv.addRequires(required, tagSpec)
 		}
 
 		if tagSpec.Deprecation != nil {
@@ -811,9 +1264,9 @@ func (conv *Converter) FittingToAMPSpec(tagSpec *amppb.TagSpec, rootTag html2htm
 	return nil
 }
 
-func (conv *Converter) ConvertToFullHTML(tag html2html.Tag) (html2html.Tag, error) {
+func (conv *Converter) ConvertToFullHTML(ctx context.Context, tag html2html.Tag) (html2html.Tag, error) {
 
-	tag, styleMap, err := conv.ReplaceToAMPTag(tag)
+	tag, styleSheets, err := conv.ReplaceToAMPTag(ctx, tag)
 	if err != nil {
 		return nil, err
 	}
@@ -823,7 +1276,7 @@ func (conv *Converter) ConvertToFullHTML(tag html2html.Tag) (html2html.Tag, erro
 		return nil, errors.New("unexpected state, root is not document root")
 	}
 
-	style, err := conv.StyleToAMPCustomTag(styleMap)
+	style, err := conv.StyleToAMPCustomTag(rootTag, styleSheets)
 	if err != nil {
 		return nil, err
 	}
@@ -834,7 +1287,8 @@ func (conv *Converter) ConvertToFullHTML(tag html2html.Tag) (html2html.Tag, erro
 		return nil, err
 	}
 
-	// TODO verify Requires
+	conv.verifyMandatoryAlternatives(rootTag)
+	conv.verifyRequires(rootTag)
 
 	err = nil
 	if len(conv.ampErrors) != 0 {
@@ -862,6 +1316,53 @@ func (conv *Converter) tagMatchedSpecs(tag html2html.Tag) []*amppb.TagSpec {
 	return resultList
 }
 
+// dispatchTagSpec returns the single TagSpec intended for tag, the attrs of tag are fixed by it.
+// the spec whose dispatch_key attr matches to tag is chosen first, even if tag doesn't satisfy the spec yet.
+// otherwise the matched spec which knows the most attrs of tag is chosen.
+func (conv *Converter) dispatchTagSpec(tag html2html.Tag) *amppb.TagSpec {
+	for _, tagSpec := range conv.ampValidatorRules.rules.GetTags() {
+		if !conv.ampValidatorRules.isTargetHTMLFormat(tagSpec) || !strings.EqualFold(tagSpec.GetTagName(), tag.Name()) {
+			continue
+		}
+		for _, attrSpec := range conv.ampValidatorRules.getAttrSpecs(tagSpec) {
+			if attrSpec.GetDispatchKey() && isAttrSpecMatch(attrSpec, tag.GetAttr(attrSpec.GetName())) {
+				return tagSpec
+			}
+		}
+	}
+
+	var bestSpec *amppb.TagSpec
+	bestScore, bestMandatory := -1, -1
+	for _, tagSpec := range conv.tagMatchedSpecs(tag) {
+		attrSpecs := conv.ampValidatorRules.getAttrSpecs(tagSpec)
+
+		score := 0
+		for _, attr := range tag.Attrs() {
+			for _, attrSpec := range attrSpecs {
+				if isAttrSpecMatch(attrSpec, attr) {
+					score++
+					break
+				}
+			}
+		}
+		mandatory := 0
+		for _, attrSpec := range attrSpecs {
+			if attrSpec.GetMandatory() {
+				mandatory++
+			}
+		}
+
+		// the more specific spec wins on the tie
+		if bestScore < score || (bestScore == score && bestMandatory < mandatory) {
+			bestSpec = tagSpec
+			bestScore = score
+			bestMandatory = mandatory
+		}
+	}
+
+	return bestSpec
+}
+
 func (conv *Converter) specMatchedTags(tagSpec *amppb.TagSpec, rootTag html2html.Tag) []html2html.Tag {
 	attrSpecs := conv.ampValidatorRules.getAttrSpecs(tagSpec)
 
@@ -913,17 +1414,8 @@ func (conv *Converter) specMatchedTags(tagSpec *amppb.TagSpec, rootTag html2html
 	return resultList
 }
 func (conv *Converter) isSpecMatchedTag(tagSpec *amppb.TagSpec, tag html2html.Tag) bool {
-	if htmlFormats := tagSpec.GetHtmlFormat(); len(htmlFormats) != 0 {
-		found := false
-		for _, htmlFormat := range htmlFormats {
-			if htmlFormat == conv.ampValidatorRules.targetHTMLFormat {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
-		}
+	if !conv.ampValidatorRules.isTargetHTMLFormat(tagSpec) {
+		return false
 	}
 
 	if tagSpec.GetTagName() == "!DOCTYPE" {
@@ -1018,7 +1510,7 @@ func (conv *Converter) tagSpecToToken(tagSpec *amppb.TagSpec) html2html.Token {
 		tag = html2html.CreateElement(strings.ToLower(tagSpec.GetTagName()))
 
 		for _, attrSpec := range conv.ampValidatorRules.getAttrSpecs(tagSpec) {
-			if !attrSpec.GetMandatory() {
+			if !attrSpec.GetMandatory() || attrSpec.GetImplicit() {
 				continue
 			}
 
@@ -1103,6 +1595,14 @@ func (conv *Converter) insertTagByTagSpec(rootTag html2html.Tag, tagSpec *amppb.
 	tags[0].AddChildTokens(tag)
 }
 
+// setTagAttr replaces the value of the attr, or adds it.
+func setTagAttr(tag html2html.Tag, key, value string) {
+	if tag.HasAttr(key) {
+		tag.RemoveAttr(key)
+	}
+	tag.AddAttr(key, value)
+}
+
 func parsePropertiesValue(attrValue string) map[string]string {
 	valueMap := make(map[string]string)
 	for _, kv := range strings.Split(attrValue, ",") {
@@ -1141,6 +1641,20 @@ func isLinkStyleSheet(token html2html.Token) bool {
 	return true
 }
 
+// isFontProviderStyleSheet reports whether tag is <link rel=stylesheet> for the whitelisted font providers.
+// href is checked as authored like the validator does, the others are inlined as the usual stylesheets.
+func (conv *Converter) isFontProviderStyleSheet(tag html2html.Tag) bool {
+	if !isLinkStyleSheet(tag) {
+		return false
+	}
+	hrefAttr := tag.GetAttr("href")
+	if hrefAttr == nil {
+		return false
+	}
+
+	return conv.ampValidatorRules.isFontProviderURL(hrefAttr.Value)
+}
+
 func isEmbedStyleSheet(token html2html.Token) bool {
 	if token.Type() != html2html.TypeTagToken {
 		return false
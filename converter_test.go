@@ -2,16 +2,14 @@ package amphtml
 
 import (
 	"bytes"
-	_ "image/jpeg"
-	_ "image/png"
-	"io"
+	"context"
 	"io/ioutil"
-	"net/url"
 	"os"
-	"path"
 	"strings"
 	"testing"
+	"testing/fstest"
 
+	"github.com/favclip/ampassador/amppb"
 	"github.com/favclip/html2html"
 )
 
@@ -53,15 +51,14 @@ func TestConverter_ConvertToFullHTML(t *testing.T) {
 			}
 
 			cURLOpt := WithCanonicalURL("https://example.com/foo/bar")
-			ffOpt := WithFileFetcher(func(targetURL *url.URL) (io.ReadCloser, error) {
-				requestedFile := path.Join("./fixture/"+dir.Name(), targetURL.Path)
-				return os.Open(requestedFile)
-			})
+			ffOpt := WithFileFetcher(FSFileFetcher(os.DirFS("./fixture/"+dir.Name()), map[string]string{
+				"example.com/foo/": ".",
+			}))
 			conv, err := NewConverter(cURLOpt, ffOpt)
 			if err != nil {
 				t.Fatal(fileName, err)
 			}
-			tag, err = conv.ConvertToFullHTML(tag)
+			tag, err = conv.ConvertToFullHTML(context.Background(), tag)
 			if ampErrors, ok := err.(AMPErrors); ok && len(ampErrors) != 0 {
 				if ampErrors.HasFatalError() {
 					t.Fatal(ampErrors)
@@ -99,3 +96,328 @@ func TestConverter_ConvertToFullHTML(t *testing.T) {
 		}
 	}
 }
+
+// newTestConverter returns the converter which has no file to fetch.
+func newTestConverter(t *testing.T) *Converter {
+	conv, err := NewConverter(WithFileFetcher(FSFileFetcher(fstest.MapFS{}, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conv
+}
+
+// findTestTagSpec returns the first TagSpec of tagName for the target html format.
+func findTestTagSpec(t *testing.T, conv *Converter, tagName string) *amppb.TagSpec {
+	for _, tagSpec := range conv.ampValidatorRules.rules.GetTags() {
+		if tagSpec.GetTagName() == tagName && conv.ampValidatorRules.isTargetHTMLFormat(tagSpec) {
+			return tagSpec
+		}
+	}
+	t.Fatal("tag spec is not found", tagName)
+	return nil
+}
+
+// flushAMPErrors returns the reported errors and the code of the first one, the errors are cleared.
+func flushAMPErrors(conv *Converter) (AMPErrors, amppb.ValidationError_Code) {
+	ampErrors := conv.ampErrors
+	conv.ampErrors = nil
+	if len(ampErrors) == 0 {
+		return nil, amppb.ValidationError_UNKNOWN_CODE
+	}
+	return ampErrors, ampErrors[0].Code
+}
+
+func TestConverter_replaceTagAttrBlacklistedValueRegex(t *testing.T) {
+	str := func(s string) *string { return &s }
+	attrSpec := &amppb.AttrSpec{
+		Name:                  str("href"),
+		BlacklistedValueRegex: str("__amp_source_origin"),
+	}
+
+	conv := &Converter{}
+	tag := html2html.CreateElement("a")
+	tag.AddAttr("href", "https://example.com/")
+	if err := conv.replaceTagAttr(tag, nil, attrSpec); err != nil {
+		t.Fatal(err)
+	}
+	if !tag.HasAttr("href") || len(conv.ampErrors) != 0 {
+		t.Error("unexpected", tag.Attrs(), conv.ampErrors)
+	}
+
+	tag = html2html.CreateElement("a")
+	tag.AddAttr("href", "https://example.com/?__amp_source_origin=foo")
+	if err := conv.replaceTagAttr(tag, nil, attrSpec); err != nil {
+		t.Fatal(err)
+	}
+	if tag.HasAttr("href") || len(conv.ampErrors) != 1 || conv.ampErrors[0].Type != AMPRemoveAttr {
+		t.Error("unexpected", tag.Attrs(), conv.ampErrors)
+	}
+}
+
+func TestConverter_fitMandatoryOneof(t *testing.T) {
+	conv := newTestConverter(t)
+	tagSpec := findTestTagSpec(t, conv, "IFRAME")
+
+	specs := []struct {
+		attrs        map[string]string
+		repair       bool
+		expectedCode amppb.ValidationError_Code
+		expectedSrc  bool
+	}{
+		{map[string]string{"src": "https://example.com/"}, false, amppb.ValidationError_UNKNOWN_CODE, true},
+		{map[string]string{}, false, amppb.ValidationError_MANDATORY_ONEOF_ATTR_MISSING, false},
+		{map[string]string{"src": "https://example.com/", "srcdoc": "<p>foo</p>"}, false, amppb.ValidationError_MUTUALLY_EXCLUSIVE_ATTRS, true},
+		// repaired
+		{map[string]string{"data-src": "https://example.com/"}, true, amppb.ValidationError_UNKNOWN_CODE, true},
+		{map[string]string{"data-src": "https://example.com/?__amp_source_origin=foo"}, true, amppb.ValidationError_UNKNOWN_CODE, false},
+		{map[string]string{"src": "https://example.com/", "srcdoc": "<p>foo</p>"}, true, amppb.ValidationError_MUTUALLY_EXCLUSIVE_ATTRS, true},
+	}
+	for _, spec := range specs {
+		tag := html2html.CreateElement("iframe")
+		for key, value := range spec.attrs {
+			tag.AddAttr(key, value)
+		}
+
+		err := conv.fitMandatoryOneof(tag, tagSpec, spec.repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ampErrors, code := flushAMPErrors(conv)
+		if code != spec.expectedCode {
+			t.Error(spec.attrs, "unexpected", ampErrors)
+		}
+		if tag.HasAttr("src") != spec.expectedSrc {
+			t.Error(spec.attrs, "unexpected", tag.Attrs())
+		}
+		if spec.repair && tag.HasAttr("src") && tag.HasAttr("srcdoc") {
+			t.Error(spec.attrs, "srcdoc must be removed")
+		}
+	}
+}
+
+func TestConverter_replaceTagAttrTrigger(t *testing.T) {
+	conv := newTestConverter(t)
+
+	findAttrSpec := func(name string) *amppb.AttrSpec {
+		for _, attrSpec := range conv.ampValidatorRules.findAttrList("$GLOBAL_ATTRS").GetAttrs() {
+			if attrSpec.GetName() == name {
+				return attrSpec
+			}
+		}
+		t.Fatal("attr spec is not found", name)
+		return nil
+	}
+
+	tag := html2html.CreateElement("div")
+	tag.AddAttr("on", "tap:sidebar.toggle")
+	if err := conv.replaceTagAttr(tag, nil, findAttrSpec("on")); err != nil {
+		t.Fatal(err)
+	}
+	if attr := tag.GetAttr("role"); attr == nil || attr.Value != "button" {
+		t.Error("unexpected", tag.Attrs())
+	}
+	if attr := tag.GetAttr("tabindex"); attr == nil || attr.Value != "0" {
+		t.Error("unexpected", tag.Attrs())
+	}
+
+	tag = html2html.CreateElement("div")
+	tag.AddAttr("on", "tap:sidebar.toggle")
+	tag.AddAttr("role", "link")
+	if err := conv.replaceTagAttr(tag, nil, findAttrSpec("on")); err != nil {
+		t.Fatal(err)
+	}
+	if attr := tag.GetAttr("role"); attr == nil || attr.Value != "link" {
+		t.Error("unexpected", tag.Attrs())
+	}
+
+	// if_value_regex doesn't match
+	tag = html2html.CreateElement("div")
+	tag.AddAttr("on", "change:form.submit")
+	if err := conv.replaceTagAttr(tag, nil, findAttrSpec("on")); err != nil {
+		t.Fatal(err)
+	}
+	if tag.HasAttr("role") || tag.HasAttr("tabindex") {
+		t.Error("unexpected", tag.Attrs())
+	}
+
+	if ampErrors, _ := flushAMPErrors(conv); len(ampErrors) != 0 {
+		t.Error("unexpected", ampErrors)
+	}
+
+	// no default value
+	tag = html2html.CreateElement("span")
+	tag.AddAttr("validation-for", "name")
+	if err := conv.replaceTagAttr(tag, nil, findAttrSpec("validation-for")); err != nil {
+		t.Fatal(err)
+	}
+	if ampErrors, code := flushAMPErrors(conv); len(ampErrors) != 1 || code != amppb.ValidationError_ATTR_REQUIRED_BUT_MISSING {
+		t.Error("unexpected", ampErrors)
+	}
+}
+
+func TestConverter_dispatchTagSpec(t *testing.T) {
+	conv := newTestConverter(t)
+
+	specs := []struct {
+		tagName  string
+		attrs    [][2]string
+		expected string
+	}{
+		{"meta", [][2]string{{"charset", "UTF-8"}}, "meta charset=utf-8"},
+		// dispatched even if the mandatory attr is missing
+		{"meta", [][2]string{{"name", "viewport"}}, "meta name=viewport"},
+		{"meta", [][2]string{{"name", "viewport"}, {"content", "width=device-width,minimum-scale=1"}}, "meta name=viewport"},
+		{"link", [][2]string{{"rel", "canonical"}, {"href", "https://example.com/"}}, "link rel=canonical"},
+		// best match
+		{"meta", [][2]string{{"name", "description"}, {"content", "foo"}}, "meta name= and content="},
+		// no spec knows charset=Shift_JIS, the generic one is chosen
+		{"meta", [][2]string{{"charset", "Shift_JIS"}}, "meta name= and content="},
+	}
+	for _, spec := range specs {
+		tag := html2html.CreateElement(spec.tagName)
+		for _, attr := range spec.attrs {
+			tag.AddAttr(attr[0], attr[1])
+		}
+
+		tagSpec := conv.dispatchTagSpec(tag)
+		if v := tagSpec.GetSpecName(); v != spec.expected {
+			t.Error(spec.attrs, "unexpected", v)
+		}
+	}
+}
+
+func TestConverter_implicitAttrs(t *testing.T) {
+	conv := newTestConverter(t)
+	tagSpec := findTestTagSpec(t, conv, "BUTTON")
+	if !conv.ampValidatorRules.isImplicitAttr(tagSpec, "role") {
+		t.Fatal("role of button must be implicit")
+	}
+
+	tag := html2html.CreateElement("button")
+	tag.AddAttr("on", "tap:sidebar.toggle")
+	for _, attrSpec := range conv.ampValidatorRules.getAttrSpecs(tagSpec) {
+		if err := conv.replaceTagAttr(tag, tagSpec, attrSpec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tag.HasAttr("role") || tag.HasAttr("tabindex") {
+		t.Error("implicit attrs must not be added", tag.Attrs())
+	}
+
+	tag.AddAttr("role", "menuitem")
+	if !conv.isSpecMatchedTag(tagSpec, tag) {
+		t.Error("implicit attrs must be valid")
+	}
+
+	token := conv.tagSpecToToken(tagSpec)
+	if token.Tag().HasAttr("role") || token.Tag().HasAttr("tabindex") {
+		t.Error("implicit attrs must not be added", token.Tag().Attrs())
+	}
+}
+
+func TestConverter_verifyRequires(t *testing.T) {
+	conv := newTestConverter(t)
+
+	getSpec := conv.ampValidatorRules.findTagSpecByName("FORM [method=GET]")
+	postSpec := conv.ampValidatorRules.findTagSpecByName("FORM [method=POST]")
+
+	rootTag := html2html.CreateDocumentRoot()
+	html := html2html.CreateElement("html")
+	head := html2html.CreateElement("head")
+	html.AddChildTokens(head)
+	rootTag.AddChildTokens(html)
+
+	conv.addRequires("amp-form extension .js script", getSpec)
+	conv.addRequires("amp-form extension .js script", getSpec)
+	conv.addRequires("unknown condition", getSpec)
+	conv.addRequires("unknown condition", postSpec)
+	conv.verifyRequires(rootTag)
+
+	scripts := head.GetElementsByTagName("script")
+	if len(scripts) != 1 {
+		t.Fatal("unexpected", len(scripts))
+	}
+	// the rules don't have the extension spec of amp-form
+	if !scripts[0].HasAttrValue("custom-element", "amp-form") || !scripts[0].HasAttrValue("src", "https://cdn.ampproject.org/v0/amp-form-latest.js") {
+		t.Error("unexpected", scripts[0].Attrs())
+	}
+	if _, ok := conv.satisfied["amp-form extension .js script"]; !ok {
+		t.Error("amp-form extension .js script must be satisfied")
+	}
+
+	ampErrors, _ := flushAMPErrors(conv)
+	if len(ampErrors) != 2 {
+		t.Fatal("unexpected", ampErrors)
+	}
+	if v := ampErrors[0]; v.Type != AMPValidatorWarning || v.Code != amppb.ValidationError_TAG_REQUIRED_BY_MISSING || !strings.HasSuffix(v.Error(), "required by FORM [method=GET], inserted") {
+		t.Error("unexpected", v)
+	}
+	if v := ampErrors[1]; v.Type != AMPValidatorError || v.Code != amppb.ValidationError_TAG_REQUIRED_BY_MISSING || !strings.HasSuffix(v.Error(), "required by FORM [method=GET], FORM [method=POST]") {
+		t.Error("unexpected", v)
+	}
+
+	// satisfied already
+	delete(conv.requires, "unknown condition")
+	conv.verifyRequires(rootTag)
+	if len(conv.ampErrors) != 0 || len(head.GetElementsByTagName("script")) != 1 {
+		t.Error("unexpected", conv.ampErrors)
+	}
+
+	// the script is in head, but the rules don't know it
+	conv.satisfied = make(map[string]*amppb.TagSpec)
+	conv.verifyRequires(rootTag)
+	if len(conv.ampErrors) != 0 || len(head.GetElementsByTagName("script")) != 1 {
+		t.Error("unexpected", conv.ampErrors)
+	}
+}
+
+func TestConverter_mandatoryAlternatives(t *testing.T) {
+	conv := newTestConverter(t)
+	tagSpec := conv.ampValidatorRules.findTagSpecByName("head > style[amp-boilerplate]")
+
+	rootTag := html2html.CreateDocumentRoot()
+	html := html2html.CreateElement("html")
+	head := html2html.CreateElement("head")
+	html.AddChildTokens(head)
+	rootTag.AddChildTokens(html)
+
+	conv.verifyMandatoryAlternatives(rootTag)
+	ampErrors, _ := flushAMPErrors(conv)
+	if len(ampErrors) != 2 {
+		t.Fatal("unexpected", ampErrors)
+	}
+	for _, ampError := range ampErrors {
+		if ampError.Type != AMPValidatorError || ampError.Code != amppb.ValidationError_MANDATORY_TAG_MISSING {
+			t.Error("unexpected", ampError)
+		}
+	}
+
+	// the old variant satisfies the group
+	style := html2html.CreateElement("style")
+	style.AddChildTokens(html2html.CreateTextToken("body {opacity: 0}"))
+	head.AddChildTokens(style)
+
+	if err := conv.FittingToAMPSpec(tagSpec, rootTag); err != nil {
+		t.Fatal(err)
+	}
+	if v := head.GetElementsByTagName("style"); len(v) != 1 {
+		t.Error("unexpected", len(v))
+	}
+	if ampErrors, _ := flushAMPErrors(conv); len(ampErrors) != 0 {
+		t.Error("unexpected", ampErrors)
+	}
+
+	// the other style doesn't
+	style.ReplateChildToken(style.Tokens()[0], html2html.CreateTextToken("body {color: red}"))
+
+	if err := conv.FittingToAMPSpec(tagSpec, rootTag); err != nil {
+		t.Fatal(err)
+	}
+	if v := head.GetElementsByTagName("style"); len(v) != 2 || !v[1].HasAttr("amp-boilerplate") {
+		t.Error("unexpected", len(v))
+	}
+	if ampErrors, code := flushAMPErrors(conv); len(ampErrors) != 1 || ampErrors[0].Type != AMPValidatorWarning || code != amppb.ValidationError_MANDATORY_TAG_MISSING {
+		t.Error("unexpected", ampErrors)
+	}
+}
@@ -0,0 +1,510 @@
+package amphtml
+
+import (
+	"strings"
+
+	"github.com/favclip/ampassador/amppb"
+)
+
+// CSS parser based on CSS Syntax Module Level 3.
+// unmodified rules and declarations are serialized to the same text as the source.
+
+type cssBlockKind int
+
+const (
+	cssBlockNone cssBlockKind = iota // statement at-rule like @import ...;
+	cssBlockRaw
+	cssBlockRules
+	cssBlockDeclarations
+)
+
+type cssStylesheet struct {
+	Rules    []*cssRule
+	Trailing string // whitespaces and comments after the last rule
+}
+
+type cssRule struct {
+	Leading   string     // whitespaces and comments before the rule
+	AtKeyword string     // lower cased at-rule name without "@". empty for qualified rules
+	Prelude   []cssToken // selectors for qualified rules, at-keyword and its prelude for at-rules
+
+	BlockKind    cssBlockKind
+	BlockTokens  []cssToken // for cssBlockRaw
+	Rules        []*cssRule // for cssBlockRules
+	Declarations []*cssDeclaration
+	Trailing     string // whitespaces and comments before "}"
+	Unclosed     bool   // reached EOF in the block
+}
+
+type cssDeclaration struct {
+	Leading   string
+	Tokens    []cssToken // from the property name to the end of the value
+	Semicolon bool
+}
+
+type cssParser struct {
+	tokens []cssToken
+	pos    int
+	errors []*cssError
+}
+
+func parseCSS(src string) (*cssStylesheet, []*cssError) {
+	tokens, errs := tokenizeCSS(src)
+	p := &cssParser{tokens: tokens, errors: errs}
+
+	rules, trailing := p.parseRuleList(true)
+	return &cssStylesheet{Rules: rules, Trailing: trailing}, p.errors
+}
+
+func (p *cssParser) addError(code amppb.ValidationError_Code, token cssToken, params ...string) {
+	p.errors = append(p.errors, &cssError{Code: code, Line: token.Line, Col: token.Col, Params: params})
+}
+
+func (p *cssParser) eof() bool {
+	return len(p.tokens) <= p.pos
+}
+
+func (p *cssParser) parseRuleList(topLevel bool) ([]*cssRule, string) {
+	var rules []*cssRule
+	var leading strings.Builder
+	for !p.eof() {
+		token := p.tokens[p.pos]
+		if token.isTrivia() || topLevel && (token.Type == cssTokenCDO || token.Type == cssTokenCDC) {
+			leading.WriteString(token.Raw)
+			p.pos++
+			continue
+		}
+
+		var rule *cssRule
+		if token.Type == cssTokenAtKeyword {
+			rule = p.parseAtRule()
+		} else {
+			rule = p.parseQualifiedRule()
+		}
+		if rule == nil {
+			continue
+		}
+		rule.Leading = leading.String()
+		leading.Reset()
+		rules = append(rules, rule)
+	}
+
+	return rules, leading.String()
+}
+
+// consumeBlock consumes tokens in {} block. the opening { is already consumed.
+func (p *cssParser) consumeBlock() ([]cssToken, bool) {
+	start := p.pos
+	depth := 0
+	for !p.eof() {
+		token := p.tokens[p.pos]
+		switch token.Type {
+		case cssTokenOpenCurly, cssTokenOpenParen, cssTokenOpenSquare, cssTokenFunction:
+			depth++
+		case cssTokenCloseParen, cssTokenCloseSquare:
+			if 0 < depth {
+				depth--
+			}
+		case cssTokenCloseCurly:
+			if depth == 0 {
+				p.pos++
+				return p.tokens[start : p.pos-1], true
+			}
+			depth--
+		}
+		p.pos++
+	}
+
+	return p.tokens[start:p.pos], false
+}
+
+func (p *cssParser) parseAtRule() *cssRule {
+	rule := &cssRule{AtKeyword: strings.ToLower(p.tokens[p.pos].Value)}
+	start := p.pos
+	p.pos++
+
+	depth := 0
+	for !p.eof() {
+		token := p.tokens[p.pos]
+		switch token.Type {
+		case cssTokenOpenParen, cssTokenOpenSquare, cssTokenFunction:
+			depth++
+		case cssTokenCloseParen, cssTokenCloseSquare:
+			if 0 < depth {
+				depth--
+			}
+		case cssTokenSemicolon:
+			if depth == 0 {
+				rule.Prelude = p.tokens[start:p.pos]
+				rule.BlockKind = cssBlockNone
+				p.pos++
+				return rule
+			}
+		case cssTokenOpenCurly:
+			rule.Prelude = p.tokens[start:p.pos]
+			p.pos++
+			blockTokens, closed := p.consumeBlock()
+			rule.BlockKind = cssBlockRaw
+			rule.BlockTokens = blockTokens
+			rule.Unclosed = !closed
+			return rule
+		}
+		p.pos++
+	}
+
+	// statement at-rule terminated by EOF
+	rule.Prelude = p.tokens[start:p.pos]
+	rule.BlockKind = cssBlockNone
+	rule.Unclosed = true
+	return rule
+}
+
+func (p *cssParser) parseQualifiedRule() *cssRule {
+	rule := &cssRule{}
+	start := p.pos
+
+	for !p.eof() {
+		token := p.tokens[p.pos]
+		if token.Type == cssTokenOpenCurly {
+			rule.Prelude = p.tokens[start:p.pos]
+			p.pos++
+			blockTokens, closed := p.consumeBlock()
+			rule.Unclosed = !closed
+			rule.BlockKind = cssBlockDeclarations
+			rule.Declarations, rule.Trailing = p.parseDeclarations(blockTokens)
+			if len(trimCSSTrivia(rule.Prelude)) == 0 {
+				p.addError(amppb.ValidationError_CSS_SYNTAX_MISSING_SELECTOR, token)
+				return nil
+			}
+			return rule
+		}
+		p.pos++
+	}
+
+	p.addError(amppb.ValidationError_CSS_SYNTAX_EOF_IN_PRELUDE_OF_QUALIFIED_RULE, p.tokens[start])
+	return nil
+}
+
+// parseDeclarations parses the contents of the block as declaration list. invalid declarations are dropped.
+func (p *cssParser) parseDeclarations(tokens []cssToken) ([]*cssDeclaration, string) {
+	var decls []*cssDeclaration
+	var leading strings.Builder
+
+	pos := 0
+	for pos < len(tokens) {
+		token := tokens[pos]
+		if token.isTrivia() || token.Type == cssTokenSemicolon {
+			leading.WriteString(token.Raw)
+			pos++
+			continue
+		}
+
+		// find the end of the declaration
+		start := pos
+		depth := 0
+	outer:
+		for ; pos < len(tokens); pos++ {
+			switch tokens[pos].Type {
+			case cssTokenOpenCurly, cssTokenOpenParen, cssTokenOpenSquare, cssTokenFunction:
+				depth++
+			case cssTokenCloseCurly, cssTokenCloseParen, cssTokenCloseSquare:
+				if 0 < depth {
+					depth--
+				}
+			case cssTokenSemicolon:
+				if depth == 0 {
+					break outer
+				}
+			}
+		}
+		decl := &cssDeclaration{
+			Leading:   leading.String(),
+			Tokens:    tokens[start:pos],
+			Semicolon: pos < len(tokens),
+		}
+		if decl.Semicolon {
+			pos++
+		}
+
+		if token.Type != cssTokenIdent {
+			p.addError(amppb.ValidationError_CSS_SYNTAX_INVALID_DECLARATION, token)
+			continue
+		}
+		if decl.colonIndex() == -1 {
+			p.addError(amppb.ValidationError_CSS_SYNTAX_INCOMPLETE_DECLARATION, token, token.Value)
+			continue
+		}
+		if decl.hasBadToken() {
+			// already reported by the tokenizer
+			continue
+		}
+
+		leading.Reset()
+		decls = append(decls, decl)
+	}
+
+	return decls, leading.String()
+}
+
+// parseBlockAsRules parses the raw block of the at-rule as rule list.
+func (rule *cssRule) parseBlockAsRules() []*cssError {
+	if rule.BlockKind != cssBlockRaw {
+		return nil
+	}
+	p := &cssParser{tokens: rule.BlockTokens}
+	rule.Rules, rule.Trailing = p.parseRuleList(false)
+	rule.BlockKind = cssBlockRules
+	rule.BlockTokens = nil
+	return p.errors
+}
+
+// parseBlockAsDeclarations parses the raw block of the at-rule as declaration list.
+func (rule *cssRule) parseBlockAsDeclarations() []*cssError {
+	if rule.BlockKind != cssBlockRaw {
+		return nil
+	}
+	p := &cssParser{tokens: rule.BlockTokens}
+	rule.Declarations, rule.Trailing = p.parseDeclarations(rule.BlockTokens)
+	rule.BlockKind = cssBlockDeclarations
+	rule.BlockTokens = nil
+	return p.errors
+}
+
+// closeBlocks closes the blocks which reached EOF.
+func (sheet *cssStylesheet) closeBlocks() {
+	closeCSSRules(sheet.Rules)
+}
+
+func closeCSSRules(rules []*cssRule) {
+	for _, rule := range rules {
+		rule.Unclosed = false
+		closeCSSRules(rule.Rules)
+	}
+}
+
+func (rule *cssRule) isAtRule() bool {
+	return rule.AtKeyword != ""
+}
+
+// PreludeString returns the prelude without the at-keyword. e.g. "screen and (min-width: 768px)" for @media.
+func (rule *cssRule) PreludeString() string {
+	prelude := rule.Prelude
+	if rule.isAtRule() && len(prelude) != 0 {
+		prelude = prelude[1:]
+	}
+	return strings.TrimSpace(cssTokensString(prelude))
+}
+
+func (decl *cssDeclaration) colonIndex() int {
+	for i, token := range decl.Tokens {
+		if token.Type == cssTokenColon {
+			return i
+		}
+		if i != 0 && !token.isTrivia() {
+			return -1
+		}
+	}
+	return -1
+}
+
+func (decl *cssDeclaration) hasBadToken() bool {
+	for _, token := range decl.Tokens {
+		if token.Type == cssTokenBadString || token.Type == cssTokenBadURL {
+			return true
+		}
+	}
+	return false
+}
+
+// Name returns the lower cased property name.
+func (decl *cssDeclaration) Name() string {
+	return strings.ToLower(decl.Tokens[0].Value)
+}
+
+// ValueTokens returns the tokens after the colon.
+func (decl *cssDeclaration) ValueTokens() []cssToken {
+	return decl.Tokens[decl.colonIndex()+1:]
+}
+
+func (decl *cssDeclaration) Value() string {
+	return strings.TrimSpace(cssTokensString(decl.ValueTokens()))
+}
+
+// splitCSSSelectors splits the selector list by the top level commas.
+func splitCSSSelectors(prelude []cssToken) [][]cssToken {
+	var selectors [][]cssToken
+	depth := 0
+	start := 0
+	for i, token := range prelude {
+		switch token.Type {
+		case cssTokenOpenParen, cssTokenOpenSquare, cssTokenFunction:
+			depth++
+		case cssTokenCloseParen, cssTokenCloseSquare:
+			if 0 < depth {
+				depth--
+			}
+		case cssTokenComma:
+			if depth == 0 {
+				selectors = append(selectors, prelude[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(selectors, prelude[start:])
+}
+
+// joinCSSSelectors joins the selectors split from prelude. returns nil if no selectors are left.
+func joinCSSSelectors(selectors [][]cssToken, prelude []cssToken) []cssToken {
+	var resultList []cssToken
+	for _, selector := range selectors {
+		if len(resultList) != 0 {
+			resultList = append(resultList, cssToken{Type: cssTokenComma, Raw: ","})
+		}
+		resultList = append(resultList, selector...)
+	}
+	trimmed := trimCSSTrivia(resultList)
+	if len(trimmed) == 0 {
+		return nil
+	}
+
+	// keep the whitespaces before "{"
+	trailing := prelude[len(trimCSSTrivia(prelude)):]
+	return append(trimmed[:len(trimmed):len(trimmed)], trailing...)
+}
+
+func trimCSSTrivia(tokens []cssToken) []cssToken {
+	for len(tokens) != 0 && tokens[0].isTrivia() {
+		tokens = tokens[1:]
+	}
+	for len(tokens) != 0 && tokens[len(tokens)-1].isTrivia() {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+func cssTokensString(tokens []cssToken) string {
+	var buf strings.Builder
+	for _, token := range tokens {
+		buf.WriteString(token.Raw)
+	}
+	return buf.String()
+}
+
+func (sheet *cssStylesheet) String() string {
+	var buf strings.Builder
+	writeCSSRules(&buf, sheet.Rules)
+	buf.WriteString(sheet.Trailing)
+	return buf.String()
+}
+
+func writeCSSRules(buf *strings.Builder, rules []*cssRule) {
+	for _, rule := range rules {
+		rule.writeTo(buf)
+	}
+}
+
+func (rule *cssRule) writeTo(buf *strings.Builder) {
+	buf.WriteString(rule.Leading)
+	buf.WriteString(cssTokensString(rule.Prelude))
+
+	switch rule.BlockKind {
+	case cssBlockNone:
+		if !rule.Unclosed {
+			buf.WriteString(";")
+		}
+		return
+	case cssBlockRaw:
+		buf.WriteString("{")
+		buf.WriteString(cssTokensString(rule.BlockTokens))
+	case cssBlockRules:
+		buf.WriteString("{")
+		writeCSSRules(buf, rule.Rules)
+		buf.WriteString(rule.Trailing)
+	case cssBlockDeclarations:
+		buf.WriteString("{")
+		for _, decl := range rule.Declarations {
+			decl.writeTo(buf)
+		}
+		buf.WriteString(rule.Trailing)
+	}
+
+	if !rule.Unclosed {
+		buf.WriteString("}")
+	}
+}
+
+func (rule *cssRule) String() string {
+	var buf strings.Builder
+	rule.writeTo(&buf)
+	return buf.String()
+}
+
+func (decl *cssDeclaration) writeTo(buf *strings.Builder) {
+	buf.WriteString(decl.Leading)
+	buf.WriteString(cssTokensString(decl.Tokens))
+	if decl.Semicolon {
+		buf.WriteString(";")
+	}
+}
+
+// filterCSSRules drops the at-rules which are not allowed by cssSpec, and parses the blocks of allowed ones.
+func filterCSSRules(rules []*cssRule, cssSpec *amppb.CssSpec) ([]*cssRule, []*cssError) {
+	var errs []*cssError
+	var resultList []*cssRule
+	for _, rule := range rules {
+		if !rule.isAtRule() {
+			resultList = append(resultList, rule)
+			continue
+		}
+
+		atRuleSpec := findAtRuleSpec(cssSpec, rule.AtKeyword)
+		blockType := amppb.AtRuleSpec_PARSE_AS_ERROR
+		if atRuleSpec != nil {
+			blockType = atRuleSpec.GetType()
+		}
+		if blockType != amppb.AtRuleSpec_PARSE_AS_ERROR && rule.BlockKind == cssBlockNone {
+			// e.g. "@media screen;"
+			blockType = amppb.AtRuleSpec_PARSE_AS_ERROR
+		}
+
+		switch blockType {
+		case amppb.AtRuleSpec_PARSE_AS_ERROR:
+			errs = append(errs, &cssError{
+				Code:   amppb.ValidationError_CSS_SYNTAX_INVALID_AT_RULE,
+				Line:   rule.Prelude[0].Line,
+				Col:    rule.Prelude[0].Col,
+				Params: []string{rule.AtKeyword},
+			})
+			continue
+		case amppb.AtRuleSpec_PARSE_AS_IGNORE:
+			// keep as is
+		case amppb.AtRuleSpec_PARSE_AS_RULES:
+			errs = append(errs, rule.parseBlockAsRules()...)
+			var childErrs []*cssError
+			rule.Rules, childErrs = filterCSSRules(rule.Rules, cssSpec)
+			errs = append(errs, childErrs...)
+		case amppb.AtRuleSpec_PARSE_AS_DECLARATIONS:
+			errs = append(errs, rule.parseBlockAsDeclarations()...)
+		}
+
+		resultList = append(resultList, rule)
+	}
+
+	return resultList, errs
+}
+
+func findAtRuleSpec(cssSpec *amppb.CssSpec, name string) *amppb.AtRuleSpec {
+	var defaultSpec *amppb.AtRuleSpec
+	for _, atRuleSpec := range cssSpec.GetAtRuleSpec() {
+		if atRuleSpec.GetName() == "$DEFAULT" {
+			defaultSpec = atRuleSpec
+			continue
+		}
+		if strings.ToLower(atRuleSpec.GetName()) == name {
+			return atRuleSpec
+		}
+	}
+
+	return defaultSpec
+}
@@ -0,0 +1,150 @@
+package amphtml
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/favclip/ampassador/amppb"
+)
+
+func loadTestRules(t *testing.T) *wrappedRules {
+	b, err := ioutil.ReadFile("./amppb/validator-main.protoascii")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := newWrappedRules(string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestParseCSSRoundTrip(t *testing.T) {
+	specs := []string{
+		"span { color: red; }",
+		"  /* comment */ .a,.b>c{color:red;background:url( 'a.png' )}\n",
+		"@media screen and (min-width: 768px) { .a { color: red } }",
+		"@font-face { font-family: 'Foo'; src: url(foo.woff) format('woff') }",
+		"@keyframes spin { from { transform: rotate(0deg) } to { transform: rotate(360deg) } }",
+		"a[href^=\"http\"] { content: \"\\201C\" }",
+		"<!-- .a { color: red } -->",
+		".a { color: red",
+	}
+	for _, spec := range specs {
+		sheet, errs := parseCSS(spec)
+		if len(errs) != 0 {
+			t.Error(spec, "unexpected", errs)
+		}
+		if v := sheet.String(); v != spec {
+			t.Errorf("unexpected, expected: %q, actual: %q", spec, v)
+		}
+	}
+}
+
+func TestCloseCSSBlocks(t *testing.T) {
+	sheet, errs := parseCSS("@media screen { .a { color: red")
+	if len(errs) != 0 {
+		t.Error("unexpected", errs)
+	}
+	sheet.Rules[0].parseBlockAsRules()
+	sheet.closeBlocks()
+
+	next, _ := parseCSS(".b { color: blue }")
+	if v := joinCSSStylesheets([]*cssStylesheet{sheet, next}); v != "@media screen { .a { color: red}}\n.b { color: blue }\n" {
+		t.Errorf("unexpected: %q", v)
+	}
+}
+
+func TestParseCSSDeclarations(t *testing.T) {
+	sheet, errs := parseCSS(".a { color : red ; margin:0 auto; ; }")
+	if len(errs) != 0 {
+		t.Error("unexpected", errs)
+	}
+	if len(sheet.Rules) != 1 {
+		t.Fatal("unexpected", len(sheet.Rules))
+	}
+	rule := sheet.Rules[0]
+	if v := cssTokensString(trimCSSTrivia(rule.Prelude)); v != ".a" {
+		t.Error("unexpected", v)
+	}
+	if len(rule.Declarations) != 2 {
+		t.Fatal("unexpected", len(rule.Declarations))
+	}
+	if v := rule.Declarations[0].Name(); v != "color" {
+		t.Error("unexpected", v)
+	}
+	if v := rule.Declarations[0].Value(); v != "red" {
+		t.Error("unexpected", v)
+	}
+	if v := rule.Declarations[1].Value(); v != "0 auto" {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestParseCSSErrors(t *testing.T) {
+	specs := []struct {
+		src      string
+		code     amppb.ValidationError_Code
+		expected string
+	}{
+		{".a { color: red } /* comment", amppb.ValidationError_CSS_SYNTAX_UNTERMINATED_COMMENT, ".a { color: red } "},
+		{".a { content: 'abc\n; color: red }", amppb.ValidationError_CSS_SYNTAX_UNTERMINATED_STRING, ".a {  color: red }"},
+		{".a { color red; background: blue }", amppb.ValidationError_CSS_SYNTAX_INCOMPLETE_DECLARATION, ".a {  background: blue }"},
+		{"{ color: red } .a { color: blue }", amppb.ValidationError_CSS_SYNTAX_MISSING_SELECTOR, " .a { color: blue }"},
+		{".a { content: \"abc", amppb.ValidationError_CSS_SYNTAX_UNTERMINATED_STRING, ".a { "},
+		{".a { background: url(a.png", amppb.ValidationError_CSS_SYNTAX_BAD_URL, ".a { "},
+	}
+	for _, spec := range specs {
+		sheet, errs := parseCSS(spec.src)
+		if len(errs) == 0 {
+			t.Error(spec.src, "error expected")
+			continue
+		}
+		if errs[0].Code != spec.code {
+			t.Error(spec.src, "unexpected", errs[0].Code)
+		}
+		if v := sheet.String(); v != spec.expected {
+			t.Errorf("unexpected, expected: %q, actual: %q", spec.expected, v)
+		}
+	}
+}
+
+func TestFilterCSSRules(t *testing.T) {
+	rules := loadTestRules(t)
+	cssSpec := rules.findAMPCustomStyleSpec().GetCdata().GetCssSpec()
+	if cssSpec == nil {
+		t.Fatal("css spec of amp-custom is not found")
+	}
+
+	src := `@charset "utf-8";
+@import url(foo.css);
+.a { color: red }
+@media screen { .b { color: blue } @page { margin: 0 } }
+@font-face { font-family: Foo; src: url(foo.woff) }
+`
+	sheet, errs := parseCSS(src)
+	if len(errs) != 0 {
+		t.Fatal("unexpected", errs)
+	}
+	sheet.Rules, errs = filterCSSRules(sheet.Rules, cssSpec)
+
+	var removed []string
+	for _, err := range errs {
+		if err.Code != amppb.ValidationError_CSS_SYNTAX_INVALID_AT_RULE {
+			t.Error("unexpected", err.Code)
+		}
+		removed = append(removed, err.Params[0])
+	}
+	if len(removed) != 3 || removed[0] != "charset" || removed[1] != "import" || removed[2] != "page" {
+		t.Error("unexpected", removed)
+	}
+
+	expected := `
+.a { color: red }
+@media screen { .b { color: blue } }
+@font-face { font-family: Foo; src: url(foo.woff) }
+`
+	if v := sheet.String(); v != expected {
+		t.Errorf("unexpected, expected: %q, actual: %q", expected, v)
+	}
+}
@@ -0,0 +1,199 @@
+package amphtml
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/favclip/ampassador/amppb"
+)
+
+// properties which AMP disallows in any value.
+var disallowedCSSProperties = map[string]bool{
+	"behavior":     true,
+	"-moz-binding": true,
+	"-ms-filter":   true,
+}
+
+type cssBlacklist struct {
+	re      *regexp.Regexp
+	message string
+}
+
+type cssSanitizer struct {
+	blacklists []*cssBlacklist
+	errors     []*cssError
+}
+
+// sanitizeCSS removes the css constructs which AMP disallows.
+// !important is rewritten, the other declarations, selectors and comments are removed.
+func sanitizeCSS(sheet *cssStylesheet, cdataSpec *amppb.CdataSpec) ([]*cssError, error) {
+	s := &cssSanitizer{}
+	for _, blacklist := range cdataSpec.GetBlacklistedCdataRegex() {
+		re, err := regexp.Compile(blacklist.GetRegex())
+		if err != nil {
+			return nil, err
+		}
+		s.blacklists = append(s.blacklists, &cssBlacklist{re: re, message: blacklist.GetErrorMessage()})
+	}
+
+	sheet.Rules = s.sanitizeRules(sheet.Rules)
+	sheet.Trailing = s.sanitizeTrivia(sheet.Trailing, cssToken{})
+
+	return s.errors, nil
+}
+
+func (s *cssSanitizer) addError(code amppb.ValidationError_Code, token cssToken, params ...string) {
+	s.errors = append(s.errors, &cssError{Code: code, Line: token.Line, Col: token.Col, Params: params})
+}
+
+// violation returns the error message of the blacklist which matches to text.
+func (s *cssSanitizer) violation(text string) (string, bool) {
+	for _, blacklist := range s.blacklists {
+		if blacklist.re.MatchString(text) {
+			return blacklist.message, true
+		}
+	}
+	return "", false
+}
+
+func (s *cssSanitizer) sanitizeRules(rules []*cssRule) []*cssRule {
+	var resultList []*cssRule
+	for _, rule := range rules {
+		anchor := rule.Prelude[0]
+		rule.Leading = s.sanitizeTrivia(rule.Leading, anchor)
+
+		if rule.isAtRule() {
+			if message, ok := s.violation(cssTokensString(rule.Prelude)); ok {
+				s.addError(amppb.ValidationError_CDATA_VIOLATES_BLACKLIST, anchor, message)
+				continue
+			}
+		} else {
+			rule.Prelude = s.sanitizeSelectors(rule.Prelude)
+			if rule.Prelude == nil {
+				continue
+			}
+		}
+
+		switch rule.BlockKind {
+		case cssBlockRaw:
+			if message, ok := s.violation(cssTokensString(rule.BlockTokens)); ok {
+				s.addError(amppb.ValidationError_CDATA_VIOLATES_BLACKLIST, anchor, message)
+				continue
+			}
+		case cssBlockRules:
+			rule.Rules = s.sanitizeRules(rule.Rules)
+		case cssBlockDeclarations:
+			rule.Declarations = s.sanitizeDeclarations(rule.Declarations)
+		}
+		rule.Trailing = s.sanitizeTrivia(rule.Trailing, anchor)
+
+		resultList = append(resultList, rule)
+	}
+
+	return resultList
+}
+
+// sanitizeSelectors removes the selectors which violate the blacklists from the selector list.
+// returns nil if all selectors are removed.
+func (s *cssSanitizer) sanitizeSelectors(prelude []cssToken) []cssToken {
+	selectors := splitCSSSelectors(prelude)
+
+	var resultList [][]cssToken
+	for _, selector := range selectors {
+		if message, ok := s.violation(cssTokensString(selector)); ok {
+			anchor := prelude[0]
+			if trimmed := trimCSSTrivia(selector); len(trimmed) != 0 {
+				anchor = trimmed[0]
+			}
+			s.addError(amppb.ValidationError_CDATA_VIOLATES_BLACKLIST, anchor, message)
+			continue
+		}
+		resultList = append(resultList, selector)
+	}
+	if len(resultList) == len(selectors) {
+		return prelude
+	}
+
+	return joinCSSSelectors(resultList, prelude)
+}
+
+func (s *cssSanitizer) sanitizeDeclarations(decls []*cssDeclaration) []*cssDeclaration {
+	var resultList []*cssDeclaration
+	for _, decl := range decls {
+		anchor := decl.Tokens[0]
+		decl.Leading = s.sanitizeTrivia(decl.Leading, anchor)
+
+		name := decl.Name()
+		if disallowedCSSProperties[name] || name == "filter" && strings.Contains(strings.ToLower(decl.Value()), "progid:") {
+			// IE only behaviors. behavior and -moz-binding can run scripts.
+			s.addError(amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE, anchor, name, decl.Value())
+			continue
+		}
+
+		if tokens, ok := removeCSSImportant(decl.Tokens); ok {
+			s.addError(amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE, anchor, name, "!important")
+			decl.Tokens = tokens
+		}
+
+		if message, ok := s.violation(cssTokensString(decl.Tokens)); ok {
+			s.addError(amppb.ValidationError_CDATA_VIOLATES_BLACKLIST, anchor, message)
+			continue
+		}
+
+		resultList = append(resultList, decl)
+	}
+
+	return resultList
+}
+
+// removeCSSImportant removes "!important" and the whitespaces before it from the declaration tokens.
+func removeCSSImportant(tokens []cssToken) ([]cssToken, bool) {
+	for i, token := range tokens {
+		if !token.isDelim("!") {
+			continue
+		}
+		j := i + 1
+		for j < len(tokens) && tokens[j].isTrivia() {
+			j++
+		}
+		if j == len(tokens) || tokens[j].Type != cssTokenIdent || !strings.EqualFold(tokens[j].Value, "important") {
+			continue
+		}
+
+		start := i
+		for 0 < start && tokens[start-1].Type == cssTokenWhitespace {
+			start--
+		}
+		resultList := append([]cssToken{}, tokens[:start]...)
+		resultList = append(resultList, tokens[j+1:]...)
+		if removed, ok := removeCSSImportant(resultList); ok {
+			return removed, true
+		}
+		return resultList, true
+	}
+
+	return tokens, false
+}
+
+// sanitizeTrivia removes <!-- -->, and comments which violate the blacklists from whitespaces between rules.
+func (s *cssSanitizer) sanitizeTrivia(trivia string, anchor cssToken) string {
+	if strings.TrimSpace(trivia) == "" {
+		return trivia
+	}
+
+	tokens, _ := tokenizeCSS(trivia)
+	var buf strings.Builder
+	for _, token := range tokens {
+		if token.Type == cssTokenCDO || token.Type == cssTokenCDC {
+			// meaningless in <style>
+			continue
+		}
+		if message, ok := s.violation(token.Raw); ok {
+			s.addError(amppb.ValidationError_CDATA_VIOLATES_BLACKLIST, anchor, message)
+			continue
+		}
+		buf.WriteString(token.Raw)
+	}
+
+	return buf.String()
+}
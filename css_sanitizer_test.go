@@ -0,0 +1,89 @@
+package amphtml
+
+import (
+	"testing"
+
+	"github.com/favclip/ampassador/amppb"
+)
+
+func TestSanitizeCSS(t *testing.T) {
+	rules := loadTestRules(t)
+	cdataSpec := rules.findAMPCustomStyleSpec().GetCdata()
+
+	specs := []struct {
+		src      string
+		expected string
+		codes    []amppb.ValidationError_Code
+	}{
+		{
+			".a { color: red !important; margin: 0 }",
+			".a { color: red; margin: 0 }",
+			[]amppb.ValidationError_Code{amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE},
+		},
+		{
+			".a { color: red ! IMPORTANT }",
+			".a { color: red }",
+			[]amppb.ValidationError_Code{amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE},
+		},
+		{
+			".a, .i-amphtml-layout { color: red }",
+			".a { color: red }",
+			[]amppb.ValidationError_Code{amppb.ValidationError_CDATA_VIOLATES_BLACKLIST},
+		},
+		{
+			".i-amphtml-layout { color: red } .b { color: blue }",
+			" .b { color: blue }",
+			[]amppb.ValidationError_Code{amppb.ValidationError_CDATA_VIOLATES_BLACKLIST},
+		},
+		{
+			".a { behavior: url(a.htc); -moz-binding: url(a.xml#b); filter: progid:DXImageTransform.Microsoft.Alpha(Opacity=80); filter: blur(2px) }",
+			".a { filter: blur(2px) }",
+			[]amppb.ValidationError_Code{
+				amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE,
+				amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE,
+				amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE,
+			},
+		},
+		{
+			"@media screen { .a { color: red !important } }",
+			"@media screen { .a { color: red } }",
+			[]amppb.ValidationError_Code{amppb.ValidationError_CSS_SYNTAX_DISALLOWED_PROPERTY_VALUE},
+		},
+		{
+			"<!-- .a { color: red } -->",
+			" .a { color: red } ",
+			nil,
+		},
+		{
+			"/* from style tag */\n.a { color: red }",
+			"/* from style tag */\n.a { color: red }",
+			nil,
+		},
+	}
+	for _, spec := range specs {
+		sheet, errs := parseCSS(spec.src)
+		if len(errs) != 0 {
+			t.Fatal(spec.src, "unexpected", errs)
+		}
+		sheet.Rules, errs = filterCSSRules(sheet.Rules, cdataSpec.GetCssSpec())
+		if len(errs) != 0 {
+			t.Fatal(spec.src, "unexpected", errs)
+		}
+		errs, err := sanitizeCSS(sheet, cdataSpec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := sheet.String(); v != spec.expected {
+			t.Errorf("unexpected, expected: %q, actual: %q", spec.expected, v)
+		}
+		if len(errs) != len(spec.codes) {
+			t.Error(spec.src, "unexpected", errs)
+			continue
+		}
+		for i, code := range spec.codes {
+			if errs[i].Code != code {
+				t.Error(spec.src, "unexpected", errs[i].Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package amphtml
+
+import "strings"
+
+// cssSpecificity is the specificity of the selector, (ids, classes, types).
+// https://www.w3.org/TR/selectors-4/#specificity-rules
+type cssSpecificity [3]int
+
+func (s cssSpecificity) less(other cssSpecificity) bool {
+	for i := range s {
+		if s[i] != other[i] {
+			return s[i] < other[i]
+		}
+	}
+	return false
+}
+
+func (s cssSpecificity) add(other cssSpecificity) cssSpecificity {
+	return cssSpecificity{s[0] + other[0], s[1] + other[1], s[2] + other[2]}
+}
+
+// the pseudo-elements which can be written with single colon.
+var legacyCSSPseudoElements = map[string]bool{
+	"before":       true,
+	"after":        true,
+	"first-line":   true,
+	"first-letter": true,
+}
+
+// selectorSpecificity calculates the specificity of the complex selector.
+func selectorSpecificity(selector []cssToken) cssSpecificity {
+	var s cssSpecificity
+	for i := 0; i < len(selector); i++ {
+		token := selector[i]
+		switch {
+		case token.Type == cssTokenHash:
+			s[0]++
+		case token.isDelim(".") && i+1 < len(selector) && selector[i+1].Type == cssTokenIdent:
+			s[1]++
+			i++
+		case token.Type == cssTokenOpenSquare:
+			s[1]++
+			i = closingCSSBracket(selector, i)
+		case token.Type == cssTokenColon && i+1 < len(selector):
+			i++
+			pseudoElement := selector[i].Type == cssTokenColon
+			if pseudoElement {
+				i++
+				if len(selector) <= i {
+					break
+				}
+			}
+			next := selector[i]
+			name := strings.ToLower(next.Value)
+			if next.Type == cssTokenFunction {
+				end := closingCSSBracket(selector, i)
+				switch {
+				case pseudoElement:
+					s[2]++
+				case name == "where":
+					// always zero
+				case name == "not" || name == "is" || name == "matches" || name == "has" || name == "-webkit-any":
+					// the most specific argument
+					var maxSpecificity cssSpecificity
+					for _, arg := range splitCSSSelectors(selector[i+1 : end]) {
+						if argSpecificity := selectorSpecificity(arg); maxSpecificity.less(argSpecificity) {
+							maxSpecificity = argSpecificity
+						}
+					}
+					s = s.add(maxSpecificity)
+				default:
+					// e.g. :nth-child(2n)
+					s[1]++
+				}
+				i = end
+			} else if pseudoElement || legacyCSSPseudoElements[name] {
+				s[2]++
+			} else {
+				s[1]++
+			}
+		case token.Type == cssTokenIdent:
+			// type selector
+			s[2]++
+		}
+	}
+
+	return s
+}
+
+// closingCSSBracket returns the index of the bracket which closes tokens[i].
+func closingCSSBracket(tokens []cssToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i].Type {
+		case cssTokenFunction, cssTokenOpenParen, cssTokenOpenSquare:
+			depth++
+		case cssTokenCloseParen, cssTokenCloseSquare:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens) - 1
+}
+
+// maxCSSSpecificity returns the highest specificity in the style rules. the rules in @keyframes are not selectors.
+func maxCSSSpecificity(rules []*cssRule) cssSpecificity {
+	var maxSpecificity cssSpecificity
+	for _, rule := range rules {
+		var s cssSpecificity
+		if rule.isAtRule() {
+			if rule.BlockKind != cssBlockRules || strings.HasSuffix(rule.AtKeyword, "keyframes") {
+				continue
+			}
+			s = maxCSSSpecificity(rule.Rules)
+		} else {
+			for _, selector := range splitCSSSelectors(rule.Prelude) {
+				if selectorSpecificity := selectorSpecificity(selector); s.less(selectorSpecificity) {
+					s = selectorSpecificity
+				}
+			}
+		}
+		if maxSpecificity.less(s) {
+			maxSpecificity = s
+		}
+	}
+
+	return maxSpecificity
+}
+
+// boostCSSSpecificity makes the selectors of rules at least as specific as target, by repeating the class selector.
+// the ids are matched by :not() with an id which never appears.
+func boostCSSSpecificity(rules []*cssRule, target cssSpecificity) {
+	for _, rule := range rules {
+		if rule.isAtRule() {
+			continue
+		}
+		selectors := splitCSSSelectors(rule.Prelude)
+		for i, selector := range selectors {
+			selectors[i] = boostCSSSelector(selector, target)
+		}
+		rule.Prelude = joinCSSSelectors(selectors, rule.Prelude)
+	}
+}
+
+func boostCSSSelector(selector []cssToken, target cssSpecificity) []cssToken {
+	s := selectorSpecificity(selector)
+	if !s.less(target) {
+		return selector
+	}
+
+	// the last class selector, which points the element itself
+	classIndex := -1
+	for i := 0; i+1 < len(selector); i++ {
+		if selector[i].isDelim(".") && selector[i+1].Type == cssTokenIdent {
+			classIndex = i
+		}
+	}
+	if classIndex == -1 {
+		return selector
+	}
+
+	var boost []cssToken
+	for ; s[0] < target[0]; s[0]++ {
+		tokens, _ := tokenizeCSS(":not(#" + selector[classIndex+1].Value + "-id)")
+		boost = append(boost, tokens...)
+	}
+	for s.less(target) {
+		boost = append(boost, selector[classIndex], selector[classIndex+1])
+		s[1]++
+	}
+
+	end := classIndex + 2
+	boosted := make([]cssToken, 0, len(selector)+len(boost))
+	boosted = append(boosted, selector[:end]...)
+	boosted = append(boosted, boost...)
+	return append(boosted, selector[end:]...)
+}
@@ -0,0 +1,61 @@
+package amphtml
+
+import "testing"
+
+func TestSelectorSpecificity(t *testing.T) {
+	specs := []struct {
+		selector string
+		expected cssSpecificity
+	}{
+		{"*", cssSpecificity{0, 0, 0}},
+		{"span", cssSpecificity{0, 0, 1}},
+		{"span.h2a-span-43fe289185", cssSpecificity{0, 1, 1}},
+		{"#main .a > p", cssSpecificity{1, 1, 1}},
+		{"a[href]:hover::before", cssSpecificity{0, 2, 2}},
+		{"p:first-line", cssSpecificity{0, 0, 2}},
+		{"li:nth-child(2n+1)", cssSpecificity{0, 1, 1}},
+		{":not(#a, .b) span", cssSpecificity{1, 0, 1}},
+		{":where(#a) span", cssSpecificity{0, 0, 1}},
+	}
+	for _, spec := range specs {
+		tokens, _ := tokenizeCSS(spec.selector)
+		if v := selectorSpecificity(tokens); v != spec.expected {
+			t.Error(spec.selector, "unexpected", v)
+		}
+	}
+}
+
+func TestBoostCSSSpecificity(t *testing.T) {
+	specs := []struct {
+		author   string
+		expected string
+	}{
+		{"span { color: blue }", "span.h2a-span-43fe289185{color: red}"},
+		{".a span { color: blue }", "span.h2a-span-43fe289185{color: red}"},
+		{".a .b span { color: blue }", "span.h2a-span-43fe289185.h2a-span-43fe289185{color: red}"},
+		{"#main span { color: blue }", "span.h2a-span-43fe289185:not(#h2a-span-43fe289185-id){color: red}"},
+		{"@media screen { .a .b .c { color: blue } }", "span.h2a-span-43fe289185.h2a-span-43fe289185.h2a-span-43fe289185{color: red}"},
+		{"@keyframes spin { from { opacity: 0 } }", "span.h2a-span-43fe289185{color: red}"},
+	}
+	for _, spec := range specs {
+		author, _ := parseCSS(spec.author)
+		for _, rule := range author.Rules {
+			rule.parseBlockAsRules()
+		}
+		sheet, _ := parseCSS("span.h2a-span-43fe289185{color: red}")
+
+		boostCSSSpecificity(sheet.Rules, maxCSSSpecificity(author.Rules))
+		if v := sheet.String(); v != spec.expected {
+			t.Errorf("unexpected, expected: %q, actual: %q", spec.expected, v)
+		}
+
+		// the style attr must win as same as the original markup
+		for _, rule := range author.Rules {
+			for _, selector := range splitCSSSelectors(rule.Prelude) {
+				if selectorSpecificity(splitCSSSelectors(sheet.Rules[0].Prelude)[0]).less(selectorSpecificity(selector)) {
+					t.Error(spec.author, "style attr is overridden")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package amphtml
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/favclip/ampassador/amppb"
+)
+
+// CSS tokenizer based on CSS Syntax Module Level 3.
+// every token keeps its source text, concatenating Raw of all tokens reproduces the input.
+
+type cssTokenType int
+
+const (
+	cssTokenIdent cssTokenType = iota + 1
+	cssTokenFunction
+	cssTokenAtKeyword
+	cssTokenHash
+	cssTokenString
+	cssTokenBadString
+	cssTokenURL
+	cssTokenBadURL
+	cssTokenDelim
+	cssTokenNumber
+	cssTokenPercentage
+	cssTokenDimension
+	cssTokenWhitespace
+	cssTokenComment
+	cssTokenCDO
+	cssTokenCDC
+	cssTokenColon
+	cssTokenSemicolon
+	cssTokenComma
+	cssTokenOpenSquare
+	cssTokenCloseSquare
+	cssTokenOpenParen
+	cssTokenCloseParen
+	cssTokenOpenCurly
+	cssTokenCloseCurly
+)
+
+type cssToken struct {
+	Type  cssTokenType
+	Raw   string
+	Value string // unescaped name for ident, function, at-keyword and hash. content for string and url. unit for dimension.
+	Line  int
+	Col   int
+}
+
+func (t cssToken) isTrivia() bool {
+	return t.Type == cssTokenWhitespace || t.Type == cssTokenComment
+}
+
+func (t cssToken) isDelim(c string) bool {
+	return t.Type == cssTokenDelim && t.Raw == c
+}
+
+var _ error = &cssError{}
+
+type cssError struct {
+	Code   amppb.ValidationError_Code
+	Line   int
+	Col    int
+	Params []string
+}
+
+func (e *cssError) Error() string {
+	s := e.Code.String() + " at " + strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Col)
+	if len(e.Params) != 0 {
+		s += " " + strings.Join(e.Params, ", ")
+	}
+	return s
+}
+
+type cssTokenizer struct {
+	src    string
+	pos    int
+	line   int
+	col    int
+	errors []*cssError
+}
+
+func tokenizeCSS(src string) ([]cssToken, []*cssError) {
+	t := &cssTokenizer{src: src, line: 1, col: 1}
+
+	var tokens []cssToken
+	for t.pos < len(t.src) {
+		tokens = append(tokens, t.next())
+	}
+
+	return tokens, t.errors
+}
+
+func (t *cssTokenizer) peek(n int) byte {
+	if len(t.src) <= t.pos+n {
+		return 0
+	}
+	return t.src[t.pos+n]
+}
+
+func (t *cssTokenizer) eof(n int) bool {
+	return len(t.src) <= t.pos+n
+}
+
+func (t *cssTokenizer) advance(n int) {
+	for i := 0; i < n && t.pos < len(t.src); i++ {
+		if t.src[t.pos] == '\n' {
+			t.line++
+			t.col = 1
+		} else {
+			t.col++
+		}
+		t.pos++
+	}
+}
+
+func (t *cssTokenizer) addError(code amppb.ValidationError_Code, line, col int) {
+	t.errors = append(t.errors, &cssError{Code: code, Line: line, Col: col})
+}
+
+func isCSSWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isCSSNameStart(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || 0x80 <= c
+}
+
+func isCSSName(c byte) bool {
+	return isCSSNameStart(c) || '0' <= c && c <= '9' || c == '-'
+}
+
+func isCSSDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isCSSHexDigit(c byte) bool {
+	return isCSSDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func (t *cssTokenizer) isValidEscape(n int) bool {
+	return t.peek(n) == '\\' && !t.eof(n+1) && t.peek(n+1) != '\n'
+}
+
+func (t *cssTokenizer) startsIdentifier(n int) bool {
+	c := t.peek(n)
+	switch {
+	case c == '-':
+		return isCSSNameStart(t.peek(n+1)) || t.peek(n+1) == '-' || t.isValidEscape(n+1)
+	case isCSSNameStart(c):
+		return true
+	case c == '\\':
+		return t.isValidEscape(n)
+	}
+	return false
+}
+
+func (t *cssTokenizer) startsNumber(n int) bool {
+	c := t.peek(n)
+	switch {
+	case c == '+' || c == '-':
+		return isCSSDigit(t.peek(n+1)) || t.peek(n+1) == '.' && isCSSDigit(t.peek(n+2))
+	case c == '.':
+		return isCSSDigit(t.peek(n + 1))
+	}
+	return isCSSDigit(c)
+}
+
+func (t *cssTokenizer) next() cssToken {
+	start, line, col := t.pos, t.line, t.col
+	token := cssToken{Line: line, Col: col}
+
+	c := t.peek(0)
+	switch {
+	case c == '/' && t.peek(1) == '*':
+		end := strings.Index(t.src[t.pos+2:], "*/")
+		if end == -1 {
+			t.addError(amppb.ValidationError_CSS_SYNTAX_UNTERMINATED_COMMENT, line, col)
+			t.advance(len(t.src) - t.pos)
+			// the unterminated comment swallows the css following it, drop it.
+			token.Type = cssTokenWhitespace
+			return token
+		}
+		t.advance(end + 4)
+		token.Type = cssTokenComment
+
+	case isCSSWhitespace(c):
+		for !t.eof(0) && isCSSWhitespace(t.peek(0)) {
+			t.advance(1)
+		}
+		token.Type = cssTokenWhitespace
+
+	case c == '"' || c == '\'':
+		token.Type, token.Value = t.consumeString(c)
+
+	case c == '#':
+		if isCSSName(t.peek(1)) || t.isValidEscape(1) {
+			t.advance(1)
+			token.Type = cssTokenHash
+			token.Value = t.consumeName()
+		} else {
+			t.advance(1)
+			token.Type = cssTokenDelim
+		}
+
+	case c == '(':
+		t.advance(1)
+		token.Type = cssTokenOpenParen
+	case c == ')':
+		t.advance(1)
+		token.Type = cssTokenCloseParen
+	case c == '[':
+		t.advance(1)
+		token.Type = cssTokenOpenSquare
+	case c == ']':
+		t.advance(1)
+		token.Type = cssTokenCloseSquare
+	case c == '{':
+		t.advance(1)
+		token.Type = cssTokenOpenCurly
+	case c == '}':
+		t.advance(1)
+		token.Type = cssTokenCloseCurly
+	case c == ',':
+		t.advance(1)
+		token.Type = cssTokenComma
+	case c == ':':
+		t.advance(1)
+		token.Type = cssTokenColon
+	case c == ';':
+		t.advance(1)
+		token.Type = cssTokenSemicolon
+
+	case c == '+' || c == '.':
+		if t.startsNumber(0) {
+			token.Type, token.Value = t.consumeNumeric()
+		} else {
+			t.advance(1)
+			token.Type = cssTokenDelim
+		}
+
+	case c == '-':
+		if t.startsNumber(0) {
+			token.Type, token.Value = t.consumeNumeric()
+		} else if t.peek(1) == '-' && t.peek(2) == '>' {
+			t.advance(3)
+			token.Type = cssTokenCDC
+		} else if t.startsIdentifier(0) {
+			token.Type, token.Value = t.consumeIdentLike()
+		} else {
+			t.advance(1)
+			token.Type = cssTokenDelim
+		}
+
+	case c == '<':
+		if strings.HasPrefix(t.src[t.pos:], "<!--") {
+			t.advance(4)
+			token.Type = cssTokenCDO
+		} else {
+			t.advance(1)
+			token.Type = cssTokenDelim
+		}
+
+	case c == '@':
+		if t.startsIdentifier(1) {
+			t.advance(1)
+			token.Type = cssTokenAtKeyword
+			token.Value = t.consumeName()
+		} else {
+			t.advance(1)
+			token.Type = cssTokenDelim
+		}
+
+	case c == '\\':
+		if t.isValidEscape(0) {
+			token.Type, token.Value = t.consumeIdentLike()
+		} else {
+			t.addError(amppb.ValidationError_CSS_SYNTAX_STRAY_TRAILING_BACKSLASH, line, col)
+			t.advance(1)
+			token.Type = cssTokenDelim
+		}
+
+	case isCSSDigit(c):
+		token.Type, token.Value = t.consumeNumeric()
+
+	case isCSSNameStart(c):
+		token.Type, token.Value = t.consumeIdentLike()
+
+	default:
+		t.advance(1)
+		token.Type = cssTokenDelim
+	}
+
+	token.Raw = t.src[start:t.pos]
+	return token
+}
+
+// consumeEscape consumes an escape sequence after the backslash and returns the unescaped string.
+func (t *cssTokenizer) consumeEscape() string {
+	if t.eof(0) {
+		return "�"
+	}
+
+	if isCSSHexDigit(t.peek(0)) {
+		start := t.pos
+		for i := 0; i < 6 && !t.eof(0) && isCSSHexDigit(t.peek(0)); i++ {
+			t.advance(1)
+		}
+		v, _ := strconv.ParseUint(t.src[start:t.pos], 16, 32)
+		if isCSSWhitespace(t.peek(0)) && !t.eof(0) {
+			t.advance(1)
+		}
+		if v == 0 || 0x10FFFF < v || 0xD800 <= v && v <= 0xDFFF {
+			return "�"
+		}
+		return string(rune(v))
+	}
+
+	s := t.src[t.pos : t.pos+1]
+	t.advance(1)
+	return s
+}
+
+func (t *cssTokenizer) consumeName() string {
+	var buf strings.Builder
+	for !t.eof(0) {
+		c := t.peek(0)
+		if isCSSName(c) {
+			buf.WriteByte(c)
+			t.advance(1)
+		} else if t.isValidEscape(0) {
+			t.advance(1)
+			buf.WriteString(t.consumeEscape())
+		} else {
+			break
+		}
+	}
+	return buf.String()
+}
+
+func (t *cssTokenizer) consumeString(quote byte) (cssTokenType, string) {
+	line, col := t.line, t.col
+	t.advance(1)
+
+	var buf strings.Builder
+	for {
+		if t.eof(0) {
+			// the declaration with the unterminated string is dropped, like the one terminated by a newline
+			t.addError(amppb.ValidationError_CSS_SYNTAX_UNTERMINATED_STRING, line, col)
+			return cssTokenBadString, buf.String()
+		}
+
+		c := t.peek(0)
+		switch {
+		case c == quote:
+			t.advance(1)
+			return cssTokenString, buf.String()
+		case c == '\n':
+			// the newline is not consumed
+			t.addError(amppb.ValidationError_CSS_SYNTAX_UNTERMINATED_STRING, line, col)
+			return cssTokenBadString, buf.String()
+		case c == '\\':
+			if t.eof(1) {
+				t.advance(1)
+			} else if t.peek(1) == '\n' {
+				t.advance(2)
+			} else {
+				t.advance(1)
+				buf.WriteString(t.consumeEscape())
+			}
+		default:
+			buf.WriteByte(c)
+			t.advance(1)
+		}
+	}
+}
+
+func (t *cssTokenizer) consumeNumeric() (cssTokenType, string) {
+	if c := t.peek(0); c == '+' || c == '-' {
+		t.advance(1)
+	}
+	for isCSSDigit(t.peek(0)) {
+		t.advance(1)
+	}
+	if t.peek(0) == '.' && isCSSDigit(t.peek(1)) {
+		t.advance(1)
+		for isCSSDigit(t.peek(0)) {
+			t.advance(1)
+		}
+	}
+	if c := t.peek(0); c == 'e' || c == 'E' {
+		if isCSSDigit(t.peek(1)) {
+			t.advance(1)
+			for isCSSDigit(t.peek(0)) {
+				t.advance(1)
+			}
+		} else if (t.peek(1) == '+' || t.peek(1) == '-') && isCSSDigit(t.peek(2)) {
+			t.advance(2)
+			for isCSSDigit(t.peek(0)) {
+				t.advance(1)
+			}
+		}
+	}
+
+	if t.startsIdentifier(0) {
+		return cssTokenDimension, t.consumeName()
+	}
+	if t.peek(0) == '%' {
+		t.advance(1)
+		return cssTokenPercentage, ""
+	}
+	return cssTokenNumber, ""
+}
+
+func (t *cssTokenizer) consumeIdentLike() (cssTokenType, string) {
+	name := t.consumeName()
+
+	if t.peek(0) != '(' {
+		return cssTokenIdent, name
+	}
+
+	if strings.EqualFold(name, "url") {
+		n := 1
+		for isCSSWhitespace(t.peek(n)) && !t.eof(n) {
+			n++
+		}
+		if c := t.peek(n); c != '"' && c != '\'' {
+			t.advance(1)
+			return t.consumeURL()
+		}
+	}
+
+	t.advance(1)
+	return cssTokenFunction, name
+}
+
+// consumeURL consumes unquoted url( ... ) after "url(".
+func (t *cssTokenizer) consumeURL() (cssTokenType, string) {
+	line, col := t.line, t.col
+	for !t.eof(0) && isCSSWhitespace(t.peek(0)) {
+		t.advance(1)
+	}
+
+	var buf strings.Builder
+	for {
+		if t.eof(0) {
+			t.addError(amppb.ValidationError_CSS_SYNTAX_BAD_URL, line, col)
+			return cssTokenBadURL, ""
+		}
+
+		c := t.peek(0)
+		switch {
+		case c == ')':
+			t.advance(1)
+			return cssTokenURL, buf.String()
+		case isCSSWhitespace(c):
+			for !t.eof(0) && isCSSWhitespace(t.peek(0)) {
+				t.advance(1)
+			}
+			if t.eof(0) || t.peek(0) == ')' {
+				t.advance(1)
+				return cssTokenURL, buf.String()
+			}
+			t.consumeBadURLRemnants(line, col)
+			return cssTokenBadURL, ""
+		case c == '"' || c == '\'' || c == '(' || c < 0x20 || c == 0x7f:
+			t.consumeBadURLRemnants(line, col)
+			return cssTokenBadURL, ""
+		case c == '\\':
+			if t.isValidEscape(0) {
+				t.advance(1)
+				buf.WriteString(t.consumeEscape())
+			} else {
+				t.consumeBadURLRemnants(line, col)
+				return cssTokenBadURL, ""
+			}
+		default:
+			buf.WriteByte(c)
+			t.advance(1)
+		}
+	}
+}
+
+func (t *cssTokenizer) consumeBadURLRemnants(line, col int) {
+	t.addError(amppb.ValidationError_CSS_SYNTAX_BAD_URL, line, col)
+	for !t.eof(0) {
+		if t.peek(0) == ')' {
+			t.advance(1)
+			return
+		}
+		if t.isValidEscape(0) {
+			t.advance(1)
+			t.consumeEscape()
+			continue
+		}
+		t.advance(1)
+	}
+}
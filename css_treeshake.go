@@ -0,0 +1,135 @@
+package amphtml
+
+import (
+	"strings"
+
+	"github.com/favclip/html2html"
+)
+
+// classes which the AMP runtime adds to the elements by itself.
+var ampRuntimeClassPrefixes = []string{"amp-", "-amp-", "user-valid", "user-invalid"}
+
+// cssDocumentIndex holds the classes and ids used in the converted document.
+type cssDocumentIndex struct {
+	classes map[string]bool
+	ids     map[string]bool
+	// amp-bind can change the class attr at runtime, the classes can't be pruned
+	boundClass bool
+}
+
+func newCSSDocumentIndex(rootTag html2html.Tag) *cssDocumentIndex {
+	index := &cssDocumentIndex{
+		classes: make(map[string]bool),
+		ids:     make(map[string]bool),
+	}
+	index.walk(rootTag)
+
+	return index
+}
+
+func (index *cssDocumentIndex) walk(tag html2html.Tag) {
+	if !tag.IsDocumentRoot() {
+		if classAttr := tag.GetAttr("class"); classAttr != nil {
+			for _, className := range strings.Fields(classAttr.Value) {
+				index.classes[className] = true
+			}
+		}
+		if idAttr := tag.GetAttr("id"); idAttr != nil {
+			index.ids[idAttr.Value] = true
+		}
+		if tag.HasAttr("[class]") {
+			index.boundClass = true
+		}
+	}
+
+	for _, token := range tag.Tokens() {
+		if token.Type() != html2html.TypeTagToken {
+			continue
+		}
+		index.walk(token.Tag())
+	}
+}
+
+func (index *cssDocumentIndex) hasClass(className string) bool {
+	if index.boundClass || index.classes[className] {
+		return true
+	}
+	for _, prefix := range ampRuntimeClassPrefixes {
+		if strings.HasPrefix(className, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayMatchSelector reports whether the selector can match to any element in the document.
+// only the classes and ids are checked, type selectors, attribute selectors and the arguments of pseudo-classes are assumed to match.
+// the converter and the AMP runtime add elements and attrs after the index is made, e.g. <amp-img> and <i-amphtml-sizer>.
+func (index *cssDocumentIndex) mayMatchSelector(selector []cssToken) bool {
+	for i := 0; i < len(selector); i++ {
+		token := selector[i]
+		switch {
+		case token.Type == cssTokenFunction || token.Type == cssTokenOpenParen || token.Type == cssTokenOpenSquare:
+			// skip to the closing bracket
+			depth := 0
+			for ; i < len(selector); i++ {
+				if t := selector[i].Type; t == cssTokenFunction || t == cssTokenOpenParen || t == cssTokenOpenSquare {
+					depth++
+				} else if t == cssTokenCloseParen || t == cssTokenCloseSquare {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		case token.Type == cssTokenHash:
+			if !index.ids[token.Value] {
+				return false
+			}
+		case token.isDelim(".") && i+1 < len(selector) && selector[i+1].Type == cssTokenIdent:
+			if !index.hasClass(selector[i+1].Value) {
+				return false
+			}
+			i++
+		}
+	}
+
+	return true
+}
+
+// pruneCSSRules removes the selectors which can't match to any element in the document, and the rules which have no selectors.
+func pruneCSSRules(rules []*cssRule, index *cssDocumentIndex) []*cssRule {
+	var resultList []*cssRule
+	for _, rule := range rules {
+		if rule.isAtRule() {
+			if rule.BlockKind == cssBlockRules && !strings.HasSuffix(rule.AtKeyword, "keyframes") {
+				// @media, @supports
+				rule.Rules = pruneCSSRules(rule.Rules, index)
+				if len(rule.Rules) == 0 {
+					continue
+				}
+			}
+			resultList = append(resultList, rule)
+			continue
+		}
+
+		selectors := splitCSSSelectors(rule.Prelude)
+		var matched [][]cssToken
+		for _, selector := range selectors {
+			if index.mayMatchSelector(selector) {
+				matched = append(matched, selector)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if len(matched) != len(selectors) {
+			rule.Prelude = joinCSSSelectors(matched, rule.Prelude)
+		}
+
+		resultList = append(resultList, rule)
+	}
+
+	return resultList
+}
@@ -0,0 +1,74 @@
+package amphtml
+
+import (
+	"testing"
+
+	"github.com/favclip/html2html"
+)
+
+func TestNewCSSDocumentIndex(t *testing.T) {
+	rootTag := html2html.CreateDocumentRoot()
+	body := html2html.CreateElement("body")
+	rootTag.AddChildTokens(body)
+	div := html2html.CreateElement("div")
+	div.AddAttr("class", "container  row")
+	div.AddAttr("id", "main")
+	body.AddChildTokens(div)
+
+	index := newCSSDocumentIndex(rootTag)
+	if !index.hasClass("container") || !index.hasClass("row") {
+		t.Error("unexpected", index.classes)
+	}
+	if index.hasClass("col") {
+		t.Error("unexpected", index.classes)
+	}
+	if !index.hasClass("amp-carousel-button") {
+		t.Error("classes added by AMP runtime must be kept")
+	}
+	if !index.ids["main"] {
+		t.Error("unexpected", index.ids)
+	}
+
+	div.AddAttr("[class]", "state.className")
+	index = newCSSDocumentIndex(rootTag)
+	if !index.hasClass("col") {
+		t.Error("classes must be kept when amp-bind is used")
+	}
+}
+
+func TestPruneCSSRules(t *testing.T) {
+	index := &cssDocumentIndex{
+		classes: map[string]bool{"a": true, "b": true},
+		ids:     map[string]bool{"main": true},
+	}
+
+	specs := []struct {
+		src      string
+		expected string
+	}{
+		{".a { color: red } .c { color: blue }", ".a { color: red }"},
+		{".c, .a > span, .d { color: red }", ".a > span { color: red }"},
+		{"#main .b { color: red } #sub { color: blue }", "#main .b { color: red }"},
+		{"span:not(.c) { color: red } [class~=c] { color: blue }", "span:not(.c) { color: red } [class~=c] { color: blue }"},
+		// type and attribute selectors are not checked, the rules are kept even if no element matches
+		{"table td { color: red } input[type=checkbox] { color: blue }", "table td { color: red } input[type=checkbox] { color: blue }"},
+		{"amp-img[layout=fill] { color: red } .c { color: blue }", "amp-img[layout=fill] { color: red }"},
+		{"@media screen { .c { color: red } } @media print { .a { color: red } }", " @media print { .a { color: red } }"},
+		{"@keyframes spin { from { opacity: 0 } } @font-face { font-family: Foo }", "@keyframes spin { from { opacity: 0 } } @font-face { font-family: Foo }"},
+	}
+	for _, spec := range specs {
+		sheet, errs := parseCSS(spec.src)
+		if len(errs) != 0 {
+			t.Fatal(spec.src, "unexpected", errs)
+		}
+		for _, rule := range sheet.Rules {
+			if rule.AtKeyword == "media" {
+				rule.parseBlockAsRules()
+			}
+		}
+		sheet.Rules = pruneCSSRules(sheet.Rules, index)
+		if v := sheet.String(); v != spec.expected {
+			t.Errorf("unexpected, expected: %q, actual: %q", spec.expected, v)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package amphtml
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/favclip/ampassador/amppb"
+)
+
+// cssURLAt reads url() at tokens[i]. quote is 0 for unquoted url.
+// end is the index next to the url().
+func cssURLAt(tokens []cssToken, i int) (ref string, quote byte, end int, ok bool) {
+	token := tokens[i]
+	if token.Type == cssTokenURL {
+		return token.Value, 0, i + 1, true
+	}
+	if token.Type != cssTokenFunction || !strings.EqualFold(token.Value, "url") {
+		return "", 0, 0, false
+	}
+
+	// url("...") is tokenized as function
+	j := i + 1
+	for j < len(tokens) && tokens[j].Type == cssTokenWhitespace {
+		j++
+	}
+	if j == len(tokens) || tokens[j].Type != cssTokenString {
+		return "", 0, 0, false
+	}
+	str := tokens[j]
+	j++
+	for j < len(tokens) && tokens[j].Type == cssTokenWhitespace {
+		j++
+	}
+	if j == len(tokens) || tokens[j].Type != cssTokenCloseParen {
+		return "", 0, 0, false
+	}
+
+	return str.Value, str.Raw[0], j + 1, true
+}
+
+// formatCSSURL makes url() of u. u is quoted if quote is not 0 or it contains the characters not allowed in unquoted url.
+func formatCSSURL(u string, quote byte) string {
+	if quote == 0 {
+		if !strings.ContainsAny(u, "\"'() \t\n\\") {
+			return "url(" + u + ")"
+		}
+		quote = '"'
+	}
+
+	q := string(quote)
+	escaped := strings.NewReplacer(`\`, `\\`, q, `\`+q, "\n", `\a `).Replace(u)
+	return "url(" + q + escaped + q + ")"
+}
+
+// rewriteCSSURLs calls fn with each url() in content, and replaces it by the returned URL if ok is true.
+func rewriteCSSURLs(content string, fn func(ref string) (string, bool)) string {
+	tokens, _ := tokenizeCSS(content)
+
+	var buf strings.Builder
+	for i := 0; i < len(tokens); i++ {
+		ref, quote, end, ok := cssURLAt(tokens, i)
+		if !ok {
+			buf.WriteString(tokens[i].Raw)
+			continue
+		}
+		if newURL, ok := fn(ref); ok {
+			buf.WriteString(formatCSSURL(newURL, quote))
+		} else {
+			buf.WriteString(cssTokensString(tokens[i:end]))
+		}
+		i = end - 1
+	}
+
+	return buf.String()
+}
+
+// checkCSSURLs drops the declarations which have url() disallowed by image_url_spec, or by font_url_spec in @font-face.
+func checkCSSURLs(rules []*cssRule, cssSpec *amppb.CssSpec) []*cssError {
+	var errs []*cssError
+	for _, rule := range rules {
+		switch rule.BlockKind {
+		case cssBlockRules:
+			errs = append(errs, checkCSSURLs(rule.Rules, cssSpec)...)
+		case cssBlockDeclarations:
+			urlSpec := cssSpec.GetImageUrlSpec()
+			if rule.AtKeyword == "font-face" {
+				urlSpec = cssSpec.GetFontUrlSpec()
+			}
+
+			var resultList []*cssDeclaration
+			for _, decl := range rule.Declarations {
+				if cssErr := checkCSSDeclarationURLs(decl, urlSpec); cssErr != nil {
+					errs = append(errs, cssErr)
+					continue
+				}
+				resultList = append(resultList, decl)
+			}
+			rule.Declarations = resultList
+		}
+	}
+
+	return errs
+}
+
+func checkCSSDeclarationURLs(decl *cssDeclaration, urlSpec *amppb.UrlSpec) *cssError {
+	for i := range decl.Tokens {
+		ref, _, _, ok := cssURLAt(decl.Tokens, i)
+		if !ok {
+			continue
+		}
+		if code := validateCSSURL(ref, urlSpec); code != amppb.ValidationError_UNKNOWN_CODE {
+			token := decl.Tokens[i]
+			return &cssError{Code: code, Line: token.Line, Col: token.Col, Params: []string{decl.Name(), ref}}
+		}
+	}
+
+	return nil
+}
+
+// validateCSSURL returns the error code if ref is not allowed by urlSpec.
+func validateCSSURL(ref string, urlSpec *amppb.UrlSpec) amppb.ValidationError_Code {
+	if urlSpec == nil {
+		return amppb.ValidationError_UNKNOWN_CODE
+	}
+
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		if urlSpec.GetAllowEmpty() {
+			return amppb.ValidationError_UNKNOWN_CODE
+		}
+		return amppb.ValidationError_CSS_SYNTAX_MISSING_URL
+	}
+
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return amppb.ValidationError_CSS_SYNTAX_INVALID_URL
+	}
+
+	if refURL.Scheme == "" {
+		if !urlSpec.GetAllowRelative() {
+			return amppb.ValidationError_CSS_SYNTAX_DISALLOWED_RELATIVE_URL
+		}
+		return amppb.ValidationError_UNKNOWN_CODE
+	}
+
+	found := false
+	for _, protocol := range urlSpec.GetAllowedProtocol() {
+		if strings.ToLower(refURL.Scheme) == protocol {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return amppb.ValidationError_CSS_SYNTAX_INVALID_URL_PROTOCOL
+	}
+
+	host := strings.ToLower(refURL.Hostname())
+	for _, domain := range urlSpec.GetDisallowedDomain() {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return amppb.ValidationError_CSS_SYNTAX_DISALLOWED_DOMAIN
+		}
+	}
+
+	return amppb.ValidationError_UNKNOWN_CODE
+}
@@ -0,0 +1,74 @@
+package amphtml
+
+import (
+	"testing"
+
+	"github.com/favclip/ampassador/amppb"
+)
+
+func TestFormatCSSURL(t *testing.T) {
+	specs := []struct {
+		url      string
+		quote    byte
+		expected string
+	}{
+		{"https://example.com/a.png", 0, "url(https://example.com/a.png)"},
+		{"https://example.com/a.png", '\'', "url('https://example.com/a.png')"},
+		{"https://example.com/a(1).png", 0, `url("https://example.com/a(1).png")`},
+		{`https://example.com/"a".png`, '"', `url("https://example.com/\"a\".png")`},
+	}
+	for _, spec := range specs {
+		if v := formatCSSURL(spec.url, spec.quote); v != spec.expected {
+			t.Error(spec.url, "unexpected", v)
+		}
+	}
+}
+
+func TestValidateCSSURL(t *testing.T) {
+	rules := loadTestRules(t)
+	cssSpec := rules.findAMPCustomStyleSpec().GetCdata().GetCssSpec()
+
+	specs := []struct {
+		url      string
+		expected amppb.ValidationError_Code
+	}{
+		{"https://example.com/a.png", amppb.ValidationError_UNKNOWN_CODE},
+		{"img/a.png", amppb.ValidationError_UNKNOWN_CODE},
+		{"data:image/png;base64,AAAA", amppb.ValidationError_UNKNOWN_CODE},
+		{"", amppb.ValidationError_UNKNOWN_CODE},
+		{"javascript:alert(1)", amppb.ValidationError_CSS_SYNTAX_INVALID_URL_PROTOCOL},
+		{"ftp://example.com/a.png", amppb.ValidationError_CSS_SYNTAX_INVALID_URL_PROTOCOL},
+	}
+	for _, spec := range specs {
+		if v := validateCSSURL(spec.url, cssSpec.GetImageUrlSpec()); v != spec.expected {
+			t.Error(spec.url, "unexpected", v)
+		}
+	}
+}
+
+func TestCheckCSSURLs(t *testing.T) {
+	rules := loadTestRules(t)
+	cssSpec := rules.findAMPCustomStyleSpec().GetCdata().GetCssSpec()
+
+	sheet, errs := parseCSS(`.a { background: url("javascript:alert(1)"); color: red } @media screen { .b { background: url(vbscript:x) } }`)
+	if len(errs) != 0 {
+		t.Fatal("unexpected", errs)
+	}
+	sheet.Rules, errs = filterCSSRules(sheet.Rules, cssSpec)
+	if len(errs) != 0 {
+		t.Fatal("unexpected", errs)
+	}
+
+	errs = checkCSSURLs(sheet.Rules, cssSpec)
+	if len(errs) != 2 {
+		t.Fatal("unexpected", errs)
+	}
+	for _, err := range errs {
+		if err.Code != amppb.ValidationError_CSS_SYNTAX_INVALID_URL_PROTOCOL {
+			t.Error("unexpected", err.Code)
+		}
+	}
+	if v := sheet.String(); v != ".a { color: red } @media screen { .b {} }" {
+		t.Error("unexpected", v)
+	}
+}
@@ -0,0 +1,108 @@
+package amphtml
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+type dataURI struct {
+	MediaType string
+	Data      []byte
+}
+
+func isDataURI(value string) bool {
+	value = strings.TrimSpace(value)
+	return len(value) >= 5 && strings.EqualFold(value[0:5], "data:")
+}
+
+// parseDataURI parses RFC 2397 data: URI.
+func parseDataURI(value string) (*dataURI, error) {
+	if !isDataURI(value) {
+		return nil, errors.New("not a data URI")
+	}
+	value = strings.TrimSpace(value)[5:]
+
+	idx := strings.Index(value, ",")
+	if idx == -1 {
+		return nil, errors.New("malformed data URI")
+	}
+	header, body := value[:idx], value[idx+1:]
+
+	isBase64 := false
+	var params []string
+	for i, param := range strings.Split(header, ";") {
+		param = strings.TrimSpace(param)
+		if i != 0 && strings.EqualFold(param, "base64") {
+			isBase64 = true
+			continue
+		}
+		params = append(params, param)
+	}
+	mediaType := strings.ToLower(params[0])
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+
+	var data []byte
+	if isBase64 {
+		body, err := url.PathUnescape(body)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, body)
+		data, err = base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(body, "="))
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		s, err := url.PathUnescape(body)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(s)
+	}
+
+	return &dataURI{MediaType: mediaType, Data: data}, nil
+}
+
+// dataURIImageSize decodes inline image in process, returns the decoded bytes too.
+// If it is larger than maxInlineImageBytes, it is written through the AssetSink and returns its URL.
+func (conv *Converter) dataURIImageSize(ctx context.Context, value string) (*url.URL, []byte, int, int, error) {
+	d, err := parseDataURI(value)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	width, height, _, err := decodeImageSize(bytes.NewReader(d.Data))
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	if conv.assetSink != nil && conv.maxInlineImageBytes < len(d.Data) {
+		assetURL, err := conv.assetSink(ctx, d.MediaType, d.Data)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		return assetURL, d.Data, width, height, nil
+	}
+
+	imgURL, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	return imgURL, d.Data, width, height, nil
+}
@@ -0,0 +1,79 @@
+package amphtml
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+const testPNGDataURI = "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAIAAAABCAIAAAB7QOjdAAAADUlEQVR4nGP4zwAE/wEHAAH/4iOeWQAAAABJRU5ErkJggg=="
+
+func TestParseDataURI(t *testing.T) {
+	d, err := parseDataURI("data:,Hello%2C%20World!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d.MediaType; v != "text/plain" {
+		t.Error("unexpected", v)
+	}
+	if v := string(d.Data); v != "Hello, World!" {
+		t.Error("unexpected", v)
+	}
+
+	d, err = parseDataURI("DATA:image/svg+xml;charset=utf-8,%3Csvg%20width%3D%2210%22%20height%3D%225%22%3E%3C%2Fsvg%3E")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := d.MediaType; v != "image/svg+xml" {
+		t.Error("unexpected", v)
+	}
+	if v := string(d.Data); v != `<svg width="10" height="5"></svg>` {
+		t.Error("unexpected", v)
+	}
+
+	if _, err := parseDataURI("data:image/png;base64"); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestConverter_dataURIImageSize(t *testing.T) {
+	conv := &Converter{maxInlineImageBytes: 4096}
+
+	imgURL, data, width, height, err := conv.dataURIImageSize(context.Background(), testPNGDataURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 2 || height != 1 {
+		t.Error("unexpected", width, height)
+	}
+	if v := imgURL.String(); v != testPNGDataURI {
+		t.Error("unexpected", v)
+	}
+	if len(data) == 0 {
+		t.Error("decoded data is not returned")
+	}
+
+	var sunk []byte
+	conv.maxInlineImageBytes = 10
+	conv.assetSink = func(ctx context.Context, mediaType string, data []byte) (*url.URL, error) {
+		if mediaType != "image/png" {
+			t.Error("unexpected", mediaType)
+		}
+		sunk = data
+		return url.Parse("https://static.example.com/a.png")
+	}
+
+	imgURL, _, width, height, err = conv.dataURIImageSize(context.Background(), testPNGDataURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 2 || height != 1 {
+		t.Error("unexpected", width, height)
+	}
+	if v := imgURL.String(); v != "https://static.example.com/a.png" {
+		t.Error("unexpected", v)
+	}
+	if len(sunk) == 0 {
+		t.Error("asset is not written")
+	}
+}
@@ -19,6 +19,8 @@ const (
 	AMPDeprecation
 	AMPCreationTag
 	AMPInsertinoTag
+	AMPFetchBlocked
+	AMPRemoveCSS
 )
 
 func (v AMPErrorType) String() string {
@@ -35,6 +37,10 @@ func (v AMPErrorType) String() string {
 		return "AMPCreationTag"
 	case AMPInsertinoTag:
 		return "AMPInsertinoTag"
+	case AMPFetchBlocked:
+		return "AMPFetchBlocked"
+	case AMPRemoveCSS:
+		return "AMPRemoveCSS"
 	}
 
 	return "unknown"
@@ -42,6 +48,7 @@ func (v AMPErrorType) String() string {
 
 type AMPError struct {
 	Type AMPErrorType
+	Code amppb.ValidationError_Code
 
 	token               html2html.Token
 	validatorSourceSpec *amppb.TagSpec
@@ -49,14 +56,26 @@ type AMPError struct {
 }
 
 func (e *AMPError) Error() string {
+	var msg string
 	switch e.Type {
 	case AMPValidatorError, AMPCreationTag, AMPInsertinoTag:
-		return fmt.Sprintf("err %s spec: %s", e.Type, e.validatorSourceSpec.GetSpecName())
-	case AMPValidatorWarning, AMPRemoveAttr, AMPDeprecation:
-		return fmt.Sprintf("warn %s spec: %s", e.Type, e.validatorSourceSpec.GetSpecName())
+		msg = fmt.Sprintf("err %s spec: %s", e.Type, e.validatorSourceSpec.GetSpecName())
+	case AMPValidatorWarning, AMPRemoveAttr, AMPDeprecation, AMPRemoveCSS:
+		msg = fmt.Sprintf("warn %s spec: %s", e.Type, e.validatorSourceSpec.GetSpecName())
+	case AMPFetchBlocked:
+		return fmt.Sprintf("warn %s cause: %s", e.Type, e.cause)
+	default:
+		return "AMPError: undenifed"
 	}
 
-	return "AMPError: undenifed"
+	if e.Code != amppb.ValidationError_UNKNOWN_CODE {
+		msg += fmt.Sprintf(" code: %s", e.Code)
+	}
+	if err, ok := e.cause.(error); ok {
+		msg += fmt.Sprintf(" cause: %s", err)
+	}
+
+	return msg
 }
 
 type AMPErrors []*AMPError
@@ -69,7 +88,7 @@ func (e AMPErrors) Error() string {
 		switch ampErr.Type {
 		case AMPValidatorError, AMPCreationTag, AMPInsertinoTag:
 			errBuf.WriteString(ampErr.Error())
-		case AMPValidatorWarning, AMPRemoveAttr, AMPDeprecation:
+		case AMPValidatorWarning, AMPRemoveAttr, AMPDeprecation, AMPFetchBlocked, AMPRemoveCSS:
 			warnBuf.WriteString(ampErr.Error())
 		}
 	}
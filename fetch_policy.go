@@ -0,0 +1,203 @@
+package amphtml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultMaxRedirects = 5
+
+var _ error = &FetchBlockedError{}
+
+// ErrUnsupportedRoundTripper is returned by FetchPolicy.HTTPClient when the resolved addresses can't be checked with the Transport of the client.
+var ErrUnsupportedRoundTripper = errors.New("the resolved addresses can't be checked with the custom RoundTripper, use *http.Transport or allow private IP")
+
+// FetchBlockedError is returned when the resource is not allowed to fetch by FetchPolicy.
+type FetchBlockedError struct {
+	URL    string
+	Reason string
+}
+
+func (e *FetchBlockedError) Error() string {
+	return fmt.Sprintf("fetch %s: blocked, %s", e.URL, e.Reason)
+}
+
+// FetchPolicy restricts the resources fetched by the default FileFetcher.
+// The document is often user-controlled, it must not be able to reach to internal networks.
+type FetchPolicy struct {
+	AllowedSchemes []string // empty means http and https
+	AllowedHosts   []string // empty means any host. "*.example.com" matches subdomains of example.com
+	AllowPrivateIP bool     // loopback, private, link-local and unspecified addresses are blocked unless true
+	MaxRedirects   int      // 0 means no redirects
+}
+
+func DefaultFetchPolicy() *FetchPolicy {
+	return &FetchPolicy{
+		AllowedSchemes: []string{"http", "https"},
+		MaxRedirects:   defaultMaxRedirects,
+	}
+}
+
+var blockedIPNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"), // carrier-grade NAT
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"), // benchmarking
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"), // NAT64
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, ipNet := range blockedIPNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *FetchPolicy) checkURL(targetURL *url.URL) error {
+	schemes := p.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	found := false
+	for _, scheme := range schemes {
+		if strings.EqualFold(targetURL.Scheme, scheme) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return &FetchBlockedError{URL: targetURL.String(), Reason: fmt.Sprintf("scheme %q is not allowed", targetURL.Scheme)}
+	}
+
+	host := strings.ToLower(targetURL.Hostname())
+	if host == "" {
+		return &FetchBlockedError{URL: targetURL.String(), Reason: "host is empty"}
+	}
+	if len(p.AllowedHosts) != 0 {
+		found := false
+		for _, allowedHost := range p.AllowedHosts {
+			allowedHost = strings.ToLower(allowedHost)
+			if strings.HasPrefix(allowedHost, "*.") {
+				if strings.HasSuffix(host, allowedHost[1:]) {
+					found = true
+					break
+				}
+			} else if host == allowedHost {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &FetchBlockedError{URL: targetURL.String(), Reason: fmt.Sprintf("host %q is not allowed", host)}
+		}
+	}
+
+	if !p.AllowPrivateIP {
+		// the literal IP address is checked at here. host names are checked after DNS resolution.
+		if ip := net.ParseIP(host); ip != nil && isPrivateIP(ip) {
+			return &FetchBlockedError{URL: targetURL.String(), Reason: fmt.Sprintf("address %s is private", ip)}
+		}
+	}
+
+	return nil
+}
+
+// Wrap returns FileFetcher which checks the URL by the policy before calling fileFetcher.
+func (p *FetchPolicy) Wrap(fileFetcher FileFetcher) FileFetcher {
+	return func(ctx context.Context, targetURL *url.URL) (io.ReadCloser, error) {
+		if err := p.checkURL(targetURL); err != nil {
+			return nil, err
+		}
+		return fileFetcher(ctx, targetURL)
+	}
+}
+
+// HTTPClient returns the copy of client which enforces the policy on redirects and on the resolved addresses.
+// the resolved addresses are checked by the dialer of *http.Transport. if the client has the other RoundTripper,
+// it returns ErrUnsupportedRoundTripper unless AllowPrivateIP is true.
+func (p *FetchPolicy) HTTPClient(client *http.Client) (*http.Client, error) {
+	if client == nil {
+		client = newDefaultHTTPClient()
+	}
+	policyClient := *client
+
+	policyClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if p.MaxRedirects <= len(via) {
+			return &FetchBlockedError{URL: req.URL.String(), Reason: fmt.Sprintf("stopped after %d redirects", len(via))}
+		}
+		if err := p.checkURL(req.URL); err != nil {
+			return err
+		}
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(req, via)
+		}
+		return nil
+	}
+
+	if p.AllowPrivateIP {
+		return &policyClient, nil
+	}
+
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		// can't hook the dialer of unknown RoundTripper
+		return nil, ErrUnsupportedRoundTripper
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		// Control is called with the resolved address, just before connecting
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || isPrivateIP(ip) {
+				return &FetchBlockedError{URL: address, Reason: fmt.Sprintf("address %s is private", host)}
+			}
+			return nil
+		},
+	}
+	transport.DialContext = dialer.DialContext
+	// the proxy would be connected instead of the target. it makes the address check meaningless.
+	transport.Proxy = nil
+	policyClient.Transport = transport
+
+	return &policyClient, nil
+}
+
+func isFetchBlocked(err error) bool {
+	var blockedErr *FetchBlockedError
+	return errors.As(err, &blockedErr)
+}
@@ -0,0 +1,101 @@
+package amphtml
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFetchPolicy_checkURL(t *testing.T) {
+	policy := &FetchPolicy{
+		AllowedHosts: []string{"example.com", "*.example.net"},
+	}
+
+	specs := []struct {
+		url     string
+		blocked bool
+	}{
+		{"https://example.com/style.css", false},
+		{"https://cdn.example.net/style.css", false},
+		{"https://example.net/style.css", true},
+		{"https://evil-example.com/style.css", true},
+		{"ftp://example.com/style.css", true},
+		{"file:///etc/passwd", true},
+	}
+	for _, spec := range specs {
+		targetURL, _ := url.Parse(spec.url)
+		if err := policy.checkURL(targetURL); (err != nil) != spec.blocked {
+			t.Error(spec.url, "unexpected", err)
+		}
+	}
+
+	policy = DefaultFetchPolicy()
+	for _, rawURL := range []string{"http://169.254.169.254/latest/meta-data/", "http://127.0.0.1/", "http://[::1]/", "http://10.0.0.1/", "http://0.0.0.0/"} {
+		targetURL, _ := url.Parse(rawURL)
+		if err := policy.checkURL(targetURL); !isFetchBlocked(err) {
+			t.Error(rawURL, "unexpected", err)
+		}
+	}
+}
+
+func TestFetchPolicy_HTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	}))
+	defer server.Close()
+
+	{
+		// resolved to the loopback address
+		policy := DefaultFetchPolicy()
+		client, err := policy.HTTPClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetch := NewHTTPFileFetcher(client, 0)
+		targetURL, _ := url.Parse(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+		_, err = fetch(context.Background(), targetURL)
+		if !isFetchBlocked(err) {
+			t.Error("unexpected", err)
+		}
+	}
+	{
+		policy := DefaultFetchPolicy()
+		policy.AllowPrivateIP = true
+		policy.MaxRedirects = 2
+		client, err := policy.HTTPClient(server.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetch := NewHTTPFileFetcher(client, 0)
+		targetURL, _ := url.Parse(server.URL)
+		_, err = fetch(context.Background(), targetURL)
+		if !isFetchBlocked(err) {
+			t.Error("unexpected", err)
+		}
+	}
+	{
+		// the dialer of the custom RoundTripper can't be hooked
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("not reached")
+		})}
+		if _, err := DefaultFetchPolicy().HTTPClient(client); err != ErrUnsupportedRoundTripper {
+			t.Error("unexpected", err)
+		}
+
+		policy := DefaultFetchPolicy()
+		policy.AllowPrivateIP = true
+		if _, err := policy.HTTPClient(client); err != nil {
+			t.Error("unexpected", err)
+		}
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
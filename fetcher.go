@@ -0,0 +1,170 @@
+package amphtml
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultMaxFetchBytes = 10 * 1024 * 1024
+
+var ErrFetchTooLarge = errors.New("fetched resource exceeds the size limit")
+
+var _ error = &FetchStatusError{}
+
+// FetchStatusError is returned when the server responds with non-2xx status.
+type FetchStatusError struct {
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *FetchStatusError) Error() string {
+	return fmt.Sprintf("fetch %s: unexpected status %s", e.URL, e.Status)
+}
+
+func newDefaultHTTPClient() *http.Client {
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// NewHTTPFileFetcher returns FileFetcher which fetches targetURL by the client.
+// The body larger than maxBytes is rejected with ErrFetchTooLarge. maxBytes <= 0 means no limit.
+func NewHTTPFileFetcher(client *http.Client, maxBytes int64) FileFetcher {
+	if client == nil {
+		client = newDefaultHTTPClient()
+	}
+
+	return func(ctx context.Context, targetURL *url.URL) (io.ReadCloser, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, targetURL.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+			resp.Body.Close()
+			return nil, &FetchStatusError{
+				URL:        targetURL.String(),
+				StatusCode: resp.StatusCode,
+				Status:     resp.Status,
+			}
+		}
+
+		if 0 < maxBytes && maxBytes < resp.ContentLength {
+			resp.Body.Close()
+			return nil, ErrFetchTooLarge
+		}
+
+		if 0 < maxBytes {
+			return &limitedReadCloser{rc: resp.Body, remaining: maxBytes}, nil
+		}
+
+		return resp.Body, nil
+	}
+}
+
+// limitedReadCloser is similar to io.LimitedReader, but reports an error instead of EOF when the limit is exceeded.
+type limitedReadCloser struct {
+	rc        io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedReadCloser) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrFetchTooLarge
+	}
+
+	// read 1 byte more than remaining to detect exceeding.
+	if l.remaining+1 < int64(len(p)) {
+		p = p[0 : l.remaining+1]
+	}
+	n, err := l.rc.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), ErrFetchTooLarge
+	}
+
+	return n, err
+}
+
+func (l *limitedReadCloser) Close() error {
+	return l.rc.Close()
+}
+
+var ErrFileNotMapped = errors.New("URL is not mapped to the file system")
+
+// FSFileFetcher returns FileFetcher which reads files from fsys.
+// hostMap maps a host or a host and path prefix (e.g. "example.com" or "example.com/blog/") onto a directory in fsys.
+// URLs which are not mapped are rejected with ErrFileNotMapped, combine with WithFallback to fetch them from elsewhere.
+func FSFileFetcher(fsys fs.FS, hostMap map[string]string) FileFetcher {
+	type mapping struct {
+		prefix string
+		dir    string
+	}
+	var mappings []mapping
+	for prefix, dir := range hostMap {
+		prefix = strings.ToLower(prefix)
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		mappings = append(mappings, mapping{prefix: prefix, dir: path.Clean(dir)})
+	}
+	// longest prefix first
+	sort.Slice(mappings, func(i, j int) bool {
+		return len(mappings[i].prefix) > len(mappings[j].prefix)
+	})
+
+	return func(ctx context.Context, targetURL *url.URL) (io.ReadCloser, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// path.Clean removes all ".." elements, it can't go up above the root.
+		urlPath := path.Clean("/" + targetURL.Path)
+		if strings.HasSuffix(targetURL.Path, "/") && urlPath != "/" {
+			urlPath += "/"
+		}
+		key := strings.ToLower(targetURL.Host) + urlPath
+
+		for _, m := range mappings {
+			if !strings.HasPrefix(key, m.prefix) {
+				continue
+			}
+
+			name := path.Join(m.dir, strings.TrimPrefix(key, m.prefix))
+			if strings.HasSuffix(key, "/") {
+				name = path.Join(name, "index.html")
+			}
+			if !fs.ValidPath(name) {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+			}
+
+			return fsys.Open(name)
+		}
+
+		return nil, ErrFileNotMapped
+	}
+}
+
+// WithFallback returns FileFetcher which uses fallback when f rejects the URL with ErrFileNotMapped.
+func (f FileFetcher) WithFallback(fallback FileFetcher) FileFetcher {
+	return func(ctx context.Context, targetURL *url.URL) (io.ReadCloser, error) {
+		r, err := f(ctx, targetURL)
+		if errors.Is(err, ErrFileNotMapped) {
+			return fallback(ctx, targetURL)
+		}
+		return r, err
+	}
+}
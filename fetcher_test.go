@@ -0,0 +1,156 @@
+package amphtml
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNewHTTPFileFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/style.css":
+			w.Write([]byte("span { color: red; }"))
+		case "/large.css":
+			w.Write([]byte(strings.Repeat("a", 100)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	fetch := NewHTTPFileFetcher(server.Client(), 50)
+
+	{
+		targetURL, _ := url.Parse(server.URL + "/style.css")
+		f, err := fetch(context.Background(), targetURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := string(b); v != "span { color: red; }" {
+			t.Error("unexpected", v)
+		}
+	}
+	{
+		targetURL, _ := url.Parse(server.URL + "/notfound.css")
+		_, err := fetch(context.Background(), targetURL)
+		if statusErr, ok := err.(*FetchStatusError); !ok {
+			t.Error("unexpected", err)
+		} else if statusErr.StatusCode != http.StatusNotFound {
+			t.Error("unexpected", statusErr.StatusCode)
+		}
+	}
+	{
+		targetURL, _ := url.Parse(server.URL + "/large.css")
+		_, err := fetch(context.Background(), targetURL)
+		if err != ErrFetchTooLarge {
+			t.Error("unexpected", err)
+		}
+	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		targetURL, _ := url.Parse(server.URL + "/style.css")
+		_, err := fetch(ctx, targetURL)
+		if err == nil {
+			t.Error("error expected")
+		}
+	}
+}
+
+func TestLimitedReadCloser(t *testing.T) {
+	r := &limitedReadCloser{rc: ioutil.NopCloser(strings.NewReader("0123456789")), remaining: 10}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := string(b); v != "0123456789" {
+		t.Error("unexpected", v)
+	}
+
+	r = &limitedReadCloser{rc: ioutil.NopCloser(strings.NewReader("0123456789")), remaining: 9}
+	_, err = ioutil.ReadAll(r)
+	if err != ErrFetchTooLarge {
+		t.Error("unexpected", err)
+	}
+}
+
+func TestFSFileFetcher(t *testing.T) {
+	fsys := fstest.MapFS{
+		"public/index.html":    {Data: []byte("index")},
+		"public/css/style.css": {Data: []byte("style")},
+		"blog/post/index.html": {Data: []byte("post")},
+		"secret.txt":           {Data: []byte("secret")},
+	}
+	fetch := FSFileFetcher(fsys, map[string]string{
+		"example.com":       "public",
+		"example.com/blog/": "blog",
+	})
+
+	specs := []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com/", "index"},
+		{"https://EXAMPLE.com/css/style.css", "style"},
+		{"https://example.com/css/../css/style.css", "style"},
+		{"https://example.com/blog/post/", "post"},
+	}
+	for _, spec := range specs {
+		targetURL, _ := url.Parse(spec.url)
+		f, err := fetch(context.Background(), targetURL)
+		if err != nil {
+			t.Fatal(spec.url, err)
+		}
+		b, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(spec.url, err)
+		}
+		if v := string(b); v != spec.expected {
+			t.Error(spec.url, "unexpected", v)
+		}
+	}
+
+	for _, rawURL := range []string{"https://example.com/../secret.txt", "https://example.com/%2e%2e/secret.txt"} {
+		targetURL, _ := url.Parse(rawURL)
+		f, err := fetch(context.Background(), targetURL)
+		if err == nil {
+			f.Close()
+			t.Error(rawURL, "error expected")
+		}
+	}
+
+	{
+		targetURL, _ := url.Parse("https://example.org/style.css")
+		_, err := fetch(context.Background(), targetURL)
+		if err != ErrFileNotMapped {
+			t.Error("unexpected", err)
+		}
+
+		fallbackCalled := false
+		fetchWithFallback := fetch.WithFallback(func(ctx context.Context, targetURL *url.URL) (io.ReadCloser, error) {
+			fallbackCalled = true
+			return ioutil.NopCloser(strings.NewReader("fallback")), nil
+		})
+		f, err := fetchWithFallback(context.Background(), targetURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if !fallbackCalled {
+			t.Error("fallback is not called")
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package amphtml
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownImageFormat is returned when the format of the image is not recognized.
+var ErrUnknownImageFormat = errors.New("unknown image format")
+
+// ErrNoIntrinsicImageSize is returned when the image doesn't define its own size, e.g. SVG with no width, height and viewBox.
+var ErrNoIntrinsicImageSize = errors.New("image has no intrinsic size")
+
+// isobmffHeaderLimit is the maximum bytes to read for finding the ispe box of AVIF/HEIF.
+const isobmffHeaderLimit = 256 * 1024
+
+// decodeImageSize returns the dimensions and the format name of the image in r.
+// JPEG, PNG, GIF, WebP, SVG and AVIF/HEIF are always supported,
+// other formats are delegated to the decoders registered to the image package.
+func decodeImageSize(r io.Reader) (int, int, string, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(32)
+	if err != nil && err != io.EOF {
+		return 0, 0, "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8")):
+		config, err := jpeg.DecodeConfig(br)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return config.Width, config.Height, "jpeg", nil
+
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		config, err := png.DecodeConfig(br)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return config.Width, config.Height, "png", nil
+
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		config, err := gif.DecodeConfig(br)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return config.Width, config.Height, "gif", nil
+
+	case len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		width, height, err := decodeWebPSize(header)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return width, height, "webp", nil
+
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		b, err := ioutil.ReadAll(io.LimitReader(br, isobmffHeaderLimit))
+		if err != nil {
+			return 0, 0, "", err
+		}
+		width, height, err := decodeISOBMFFSize(b)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return width, height, "avif", nil
+
+	case isSVGHeader(header):
+		width, height, err := decodeSVGSize(br)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return width, height, "svg", nil
+	}
+
+	config, format, err := image.DecodeConfig(br)
+	if err == image.ErrFormat {
+		return 0, 0, "", ErrUnknownImageFormat
+	} else if err != nil {
+		return 0, 0, "", err
+	}
+
+	return config.Width, config.Height, format, nil
+}
+
+func decodeWebPSize(header []byte) (int, int, error) {
+	if len(header) < 30 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// lossy: frame tag (3 bytes), start code 9d 01 2a, then 14bit width and height.
+		if !bytes.Equal(header[23:26], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, errors.New("invalid VP8 start code")
+		}
+		width := int(binary.LittleEndian.Uint16(header[26:28]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(header[28:30]) & 0x3fff)
+		return width, height, nil
+
+	case "VP8L":
+		// lossless: signature 0x2f, then 14bit (width - 1) and 14bit (height - 1).
+		if header[20] != 0x2f {
+			return 0, 0, errors.New("invalid VP8L signature")
+		}
+		bits := binary.LittleEndian.Uint32(header[21:25])
+		width := int(bits&0x3fff) + 1
+		height := int((bits>>14)&0x3fff) + 1
+		return width, height, nil
+
+	case "VP8X":
+		// extended: flags (4 bytes), then 24bit (canvas width - 1) and 24bit (canvas height - 1).
+		width := int(uint32(header[24])|uint32(header[25])<<8|uint32(header[26])<<16) + 1
+		height := int(uint32(header[27])|uint32(header[28])<<8|uint32(header[29])<<16) + 1
+		return width, height, nil
+	}
+
+	return 0, 0, ErrUnknownImageFormat
+}
+
+// decodeISOBMFFSize finds ispe boxes in meta > iprp > ipco and returns the largest one.
+// smaller ones are usually thumbnails or alpha planes.
+func decodeISOBMFFSize(b []byte) (int, int, error) {
+	ftyp, ok := findISOBMFFBox(b, "ftyp")
+	if !ok || len(ftyp) < 4 {
+		return 0, 0, ErrUnknownImageFormat
+	}
+	if !isHEIFBrand(ftyp) {
+		return 0, 0, ErrUnknownImageFormat
+	}
+
+	meta, ok := findISOBMFFBox(b, "meta")
+	if !ok || len(meta) < 4 {
+		return 0, 0, ErrNoIntrinsicImageSize
+	}
+	// meta is a full box. skip version and flags.
+	iprp, ok := findISOBMFFBox(meta[4:], "iprp")
+	if !ok {
+		return 0, 0, ErrNoIntrinsicImageSize
+	}
+	ipco, ok := findISOBMFFBox(iprp, "ipco")
+	if !ok {
+		return 0, 0, ErrNoIntrinsicImageSize
+	}
+
+	width, height := 0, 0
+	for _, ispe := range findISOBMFFBoxes(ipco, "ispe") {
+		// full box (4 bytes), image_width (4 bytes), image_height (4 bytes)
+		if len(ispe) < 12 {
+			continue
+		}
+		w := int(binary.BigEndian.Uint32(ispe[4:8]))
+		h := int(binary.BigEndian.Uint32(ispe[8:12]))
+		if width*height < w*h {
+			width, height = w, h
+		}
+	}
+	if width == 0 || height == 0 {
+		return 0, 0, ErrNoIntrinsicImageSize
+	}
+
+	return width, height, nil
+}
+
+func isHEIFBrand(ftyp []byte) bool {
+	brands := []string{"avif", "avis", "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+
+	// major_brand (4 bytes), minor_version (4 bytes), compatible_brands (4 bytes each)
+	for i := 0; i+4 <= len(ftyp); i += 4 {
+		if i == 4 {
+			continue
+		}
+		for _, brand := range brands {
+			if string(ftyp[i:i+4]) == brand {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func findISOBMFFBox(b []byte, boxType string) ([]byte, bool) {
+	boxes := findISOBMFFBoxes(b, boxType)
+	if len(boxes) == 0 {
+		return nil, false
+	}
+	return boxes[0], true
+}
+
+func findISOBMFFBoxes(b []byte, boxType string) [][]byte {
+	var resultList [][]byte
+	for 8 <= len(b) {
+		size := uint64(binary.BigEndian.Uint32(b[0:4]))
+		typ := string(b[4:8])
+		headerSize := uint64(8)
+		if size == 1 {
+			if len(b) < 16 {
+				break
+			}
+			size = binary.BigEndian.Uint64(b[8:16])
+			headerSize = 16
+		} else if size == 0 {
+			size = uint64(len(b))
+		}
+		if size < headerSize {
+			break
+		}
+		if uint64(len(b)) < size {
+			// truncated. use what we have.
+			size = uint64(len(b))
+		}
+
+		if typ == boxType {
+			resultList = append(resultList, b[headerSize:size])
+		}
+		b = b[size:]
+	}
+
+	return resultList
+}
+
+func isSVGHeader(header []byte) bool {
+	header = bytes.TrimPrefix(header, []byte("\xef\xbb\xbf"))
+	header = bytes.TrimLeft(header, " \t\r\n")
+	return bytes.HasPrefix(header, []byte("<"))
+}
+
+func decodeSVGSize(r io.Reader) (int, int, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return 0, 0, ErrUnknownImageFormat
+		} else if err != nil {
+			return 0, 0, err
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local != "svg" {
+			return 0, 0, ErrUnknownImageFormat
+		}
+
+		var widthAttr, heightAttr, viewBoxAttr string
+		for _, attr := range start.Attr {
+			switch attr.Name.Local {
+			case "width":
+				widthAttr = attr.Value
+			case "height":
+				heightAttr = attr.Value
+			case "viewBox":
+				viewBoxAttr = attr.Value
+			}
+		}
+
+		return svgSize(widthAttr, heightAttr, viewBoxAttr)
+	}
+}
+
+var svgLengthRe = regexp.MustCompile(`^\s*([0-9]*\.?[0-9]+(?:[eE][-+]?[0-9]+)?)\s*(px|pt|pc|in|cm|mm)?\s*$`)
+
+var svgUnitToPx = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": 96.0 / 72.0,
+	"pc": 16,
+	"in": 96,
+	"cm": 96.0 / 2.54,
+	"mm": 96.0 / 25.4,
+}
+
+// parseSVGLength returns the length in px. relative lengths like % or em are not supported.
+func parseSVGLength(value string) (float64, bool) {
+	m := svgLengthRe.FindStringSubmatch(value)
+	if m == nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * svgUnitToPx[m[2]], true
+}
+
+func svgSize(widthAttr, heightAttr, viewBoxAttr string) (int, int, error) {
+	width, hasWidth := parseSVGLength(widthAttr)
+	height, hasHeight := parseSVGLength(heightAttr)
+
+	var vbWidth, vbHeight float64
+	if fields := strings.FieldsFunc(viewBoxAttr, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' }); len(fields) == 4 {
+		w, err1 := strconv.ParseFloat(fields[2], 64)
+		h, err2 := strconv.ParseFloat(fields[3], 64)
+		if err1 == nil && err2 == nil && 0 < w && 0 < h {
+			vbWidth, vbHeight = w, h
+		}
+	}
+
+	switch {
+	case hasWidth && hasHeight:
+		// ok
+	case hasWidth && vbWidth != 0:
+		height = width * vbHeight / vbWidth
+	case hasHeight && vbHeight != 0:
+		width = height * vbWidth / vbHeight
+	case !hasWidth && !hasHeight && vbWidth != 0:
+		width, height = vbWidth, vbHeight
+	default:
+		return 0, 0, ErrNoIntrinsicImageSize
+	}
+
+	return int(width + 0.5), int(height + 0.5), nil
+}
@@ -0,0 +1,100 @@
+package amphtml
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestDecodeImageSize(t *testing.T) {
+	vp8 := make([]byte, 30)
+	copy(vp8, "RIFF\x00\x00\x00\x00WEBPVP8 ")
+	copy(vp8[23:], []byte{0x9d, 0x01, 0x2a})
+	binary.LittleEndian.PutUint16(vp8[26:], 320)
+	binary.LittleEndian.PutUint16(vp8[28:], 240)
+
+	vp8l := make([]byte, 30)
+	copy(vp8l, "RIFF\x00\x00\x00\x00WEBPVP8L")
+	vp8l[20] = 0x2f
+	binary.LittleEndian.PutUint32(vp8l[21:], uint32(400-1)|uint32(300-1)<<14)
+
+	vp8x := make([]byte, 30)
+	copy(vp8x, "RIFF\x00\x00\x00\x00WEBPVP8X")
+	copy(vp8x[24:], []byte{0xff, 0x0f, 0x00, 0x37, 0x04, 0x00}) // 4096 x 1080
+
+	box := func(typ string, payload ...[]byte) []byte {
+		body := bytes.Join(payload, nil)
+		b := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+		copy(b[4:], typ)
+		return append(b, body...)
+	}
+	ispe := func(w, h uint32) []byte {
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint32(b[4:], w)
+		binary.BigEndian.PutUint32(b[8:], h)
+		return box("ispe", b)
+	}
+	avif := bytes.Join([][]byte{
+		box("ftyp", []byte("avif\x00\x00\x00\x00mif1avif")),
+		box("meta", make([]byte, 4), box("iprp", box("ipco", ispe(64, 48), ispe(1920, 1080)))),
+	}, nil)
+
+	specs := []struct {
+		name   string
+		data   []byte
+		width  int
+		height int
+		format string
+	}{
+		{"webp lossy", vp8, 320, 240, "webp"},
+		{"webp lossless", vp8l, 400, 300, "webp"},
+		{"webp extended", vp8x, 4096, 1080, "webp"},
+		{"avif", avif, 1920, 1080, "avif"},
+		{"svg width height", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" width="100px" height="50"></svg>`), 100, 50, "svg"},
+		{"svg viewBox", []byte(`<svg viewBox="0 0 24 12"></svg>`), 24, 12, "svg"},
+		{"svg width and viewBox", []byte(`<svg width="48" viewBox="0,0,24,12"></svg>`), 48, 24, "svg"},
+	}
+
+	for _, spec := range specs {
+		width, height, format, err := decodeImageSize(bytes.NewReader(spec.data))
+		if err != nil {
+			t.Fatal(spec.name, err)
+		}
+		if width != spec.width || height != spec.height {
+			t.Error(spec.name, "unexpected", width, height)
+		}
+		if format != spec.format {
+			t.Error(spec.name, "unexpected", format)
+		}
+	}
+}
+
+func TestDecodeImageSize_JPEG(t *testing.T) {
+	f, err := os.Open("./fixture/with-image/cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	width, height, format, err := decodeImageSize(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != 1200 || height != 800 || format != "jpeg" {
+		t.Error("unexpected", width, height, format)
+	}
+}
+
+func TestDecodeImageSize_Unknown(t *testing.T) {
+	_, _, _, err := decodeImageSize(bytes.NewReader([]byte("hello, world")))
+	if err != ErrUnknownImageFormat {
+		t.Error("unexpected", err)
+	}
+
+	_, _, _, err = decodeImageSize(bytes.NewReader([]byte(`<svg width="100%"></svg>`)))
+	if err != ErrNoIntrinsicImageSize {
+		t.Error("unexpected", err)
+	}
+}
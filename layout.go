@@ -0,0 +1,362 @@
+package amphtml
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/favclip/ampassador/amppb"
+	"github.com/favclip/html2html"
+)
+
+// e.g. 10, 1.5em, .5em, 1. or 10PX
+var cssLengthRegexp = regexp.MustCompile(`(?i)^(\d*\.?\d+|\d+\.)(px|em|rem|vh|vw|vmin|vmax)?$`)
+
+// cssLength is the value of width or height attr of AMP elements.
+type cssLength struct {
+	isSet   bool
+	isValid bool
+	isAuto  bool
+	numeral float64
+	unit    string
+}
+
+// parseCSSLength parses the value of width or height attr. the unit is px if omitted, it is lower cased.
+// allowAuto is whether "auto" may be the value at all, it is checked again by the layout in isAutoAllowed.
+func parseCSSLength(attr *html2html.Attr, allowAuto bool) cssLength {
+	if attr == nil {
+		return cssLength{isValid: true, unit: "px"}
+	}
+
+	length := cssLength{isSet: true, unit: "px"}
+	if attr.Value == "auto" {
+		length.isAuto = true
+		length.isValid = allowAuto
+		return length
+	}
+
+	m := cssLengthRegexp.FindStringSubmatch(attr.Value)
+	if m == nil {
+		return length
+	}
+	numeral, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return length
+	}
+	length.isValid = true
+	length.numeral = numeral
+	if m[2] != "" {
+		length.unit = strings.ToLower(m[2])
+	}
+
+	return length
+}
+
+// isAutoAllowed reports whether the value of attr can be "auto" for layout.
+// width=auto is only for fixed-height, height=auto is only for flex-item.
+func isAutoAllowed(attrName string, layout amppb.AmpLayout_Layout) bool {
+	switch attrName {
+	case "width":
+		return layout == amppb.AmpLayout_FIXED_HEIGHT
+	case "height":
+		return layout == amppb.AmpLayout_FLEX_ITEM
+	}
+	return false
+}
+
+// isValidSourceSizes reports whether the value of sizes or heights attr is valid, e.g. "(min-width: 650px) 50vw, 100vw".
+// each source size is a length with an optional media condition before it. heights allows the percentage too.
+func isValidSourceSizes(value string, allowPercent bool) bool {
+	for _, sourceSize := range strings.Split(value, ",") {
+		sourceSize = strings.TrimSpace(sourceSize)
+
+		var length string
+		if i := strings.LastIndex(sourceSize, "calc("); i != -1 && strings.HasSuffix(sourceSize, ")") {
+			length = sourceSize[i:]
+		} else if i := strings.LastIndexAny(sourceSize, " \t\n"); i != -1 {
+			length = sourceSize[i+1:]
+		} else {
+			length = sourceSize
+		}
+		if length != sourceSize && !strings.HasSuffix(strings.TrimSpace(strings.TrimSuffix(sourceSize, length)), ")") {
+			// the media condition ends with the parenthesized feature, e.g. "screen and (min-width: 650px)"
+			return false
+		}
+
+		switch {
+		case strings.HasPrefix(length, "calc("):
+		case allowPercent && strings.HasSuffix(length, "%"):
+			if _, err := strconv.ParseFloat(strings.TrimSuffix(length, "%"), 64); err != nil {
+				return false
+			}
+		case cssLengthRegexp.MatchString(length):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseAMPLayout parses the layout attr. e.g. "fixed-height"
+func parseAMPLayout(value string) (amppb.AmpLayout_Layout, bool) {
+	if value == "" {
+		return amppb.AmpLayout_UNKNOWN, true
+	}
+	v, ok := amppb.AmpLayout_Layout_value[strings.Replace(strings.ToUpper(value), "-", "_", -1)]
+	if !ok || amppb.AmpLayout_Layout(v) == amppb.AmpLayout_UNKNOWN {
+		return amppb.AmpLayout_UNKNOWN, false
+	}
+
+	return amppb.AmpLayout_Layout(v), true
+}
+
+// ampLayoutAttrValue returns the value of layout attr for layout.
+func ampLayoutAttrValue(layout amppb.AmpLayout_Layout) string {
+	return strings.Replace(strings.ToLower(layout.String()), "_", "-", -1)
+}
+
+// calculateLayoutWidth returns 1px if the element defines the default width.
+func calculateLayoutWidth(ampLayout *amppb.AmpLayout, layout amppb.AmpLayout_Layout, width cssLength) cssLength {
+	if (layout == amppb.AmpLayout_UNKNOWN || layout == amppb.AmpLayout_FIXED) && !width.isSet && ampLayout.GetDefinesDefaultWidth() {
+		return cssLength{isSet: true, isValid: true, numeral: 1, unit: "px"}
+	}
+	return width
+}
+
+// calculateLayoutHeight returns 1px if the element defines the default height.
+func calculateLayoutHeight(ampLayout *amppb.AmpLayout, layout amppb.AmpLayout_Layout, height cssLength) cssLength {
+	if (layout == amppb.AmpLayout_UNKNOWN || layout == amppb.AmpLayout_FIXED || layout == amppb.AmpLayout_FIXED_HEIGHT) && !height.isSet && ampLayout.GetDefinesDefaultHeight() {
+		return cssLength{isSet: true, isValid: true, numeral: 1, unit: "px"}
+	}
+	return height
+}
+
+// calculateLayout infers the layout as same as AMP runtime, if layout attr is absent.
+// https://www.ampproject.org/docs/design/amp-html-layout#layout
+func calculateLayout(layout amppb.AmpLayout_Layout, width, height cssLength, hasSizes, hasHeights bool) amppb.AmpLayout_Layout {
+	switch {
+	case layout != amppb.AmpLayout_UNKNOWN:
+		return layout
+	case !width.isSet && !height.isSet:
+		return amppb.AmpLayout_CONTAINER
+	case height.isSet && (!width.isSet || width.isAuto):
+		return amppb.AmpLayout_FIXED_HEIGHT
+	case height.isSet && width.isSet && (hasSizes || hasHeights):
+		return amppb.AmpLayout_RESPONSIVE
+	}
+
+	return amppb.AmpLayout_FIXED
+}
+
+func isSupportedLayout(ampLayout *amppb.AmpLayout, layout amppb.AmpLayout_Layout) bool {
+	for _, supported := range ampLayout.GetSupportedLayouts() {
+		if supported == layout {
+			return true
+		}
+	}
+	return false
+}
+
+// fitAMPLayout validates width, height and layout attrs of tag by amp_layout of tagSpec.
+// the attrs which are ignored by the layout are repaired.
+func (conv *Converter) fitAMPLayout(tagSpec *amppb.TagSpec, tag html2html.Tag) {
+	ampLayout := tagSpec.GetAmpLayout()
+	if ampLayout == nil {
+		return
+	}
+
+	addError := func(code amppb.ValidationError_Code, format string, a ...interface{}) {
+		conv.addAMPError(&AMPError{
+			Type:                AMPValidatorError,
+			Code:                code,
+			token:               tag,
+			validatorSourceSpec: tagSpec,
+			cause:               fmt.Errorf(format, a...),
+		})
+	}
+
+	var layoutValue string
+	if layoutAttr := tag.GetAttr("layout"); layoutAttr != nil {
+		layoutValue = layoutAttr.Value
+	}
+	inputLayout, ok := parseAMPLayout(layoutValue)
+	if !ok {
+		addError(amppb.ValidationError_INVALID_ATTR_VALUE, "layout=%q", layoutValue)
+		return
+	}
+	inputWidth := parseCSSLength(tag.GetAttr("width"), true)
+	if !inputWidth.isValid {
+		addError(amppb.ValidationError_INVALID_ATTR_VALUE, "width=%q", tag.GetAttr("width").Value)
+		return
+	}
+	inputHeight := parseCSSLength(tag.GetAttr("height"), true)
+	if !inputHeight.isValid {
+		addError(amppb.ValidationError_INVALID_ATTR_VALUE, "height=%q", tag.GetAttr("height").Value)
+		return
+	}
+
+	for _, attrName := range []string{"sizes", "heights"} {
+		if attr := tag.GetAttr(attrName); attr != nil && !isValidSourceSizes(attr.Value, attrName == "heights") {
+			addError(amppb.ValidationError_INVALID_ATTR_VALUE, "%s=%q", attrName, attr.Value)
+			return
+		}
+	}
+
+	width := calculateLayoutWidth(ampLayout, inputLayout, inputWidth)
+	height := calculateLayoutHeight(ampLayout, inputLayout, inputHeight)
+	layout := calculateLayout(inputLayout, width, height, tag.HasAttr("sizes"), tag.HasAttr("heights"))
+	layoutName := ampLayoutAttrValue(layout)
+
+	if width.isAuto && !isAutoAllowed("width", layout) {
+		addError(amppb.ValidationError_INVALID_ATTR_VALUE, "width=auto is not allowed for layout=%s", layoutName)
+		return
+	}
+	if height.isAuto && !isAutoAllowed("height", layout) {
+		addError(amppb.ValidationError_INVALID_ATTR_VALUE, "height=auto is not allowed for layout=%s", layoutName)
+		return
+	}
+	if !isSupportedLayout(ampLayout, layout) {
+		if inputLayout == amppb.AmpLayout_UNKNOWN {
+			addError(amppb.ValidationError_IMPLIED_LAYOUT_INVALID, "implied layout=%s is not supported by %s", layoutName, tag.Name())
+		} else {
+			addError(amppb.ValidationError_SPECIFIED_LAYOUT_INVALID, "layout=%s is not supported by %s", layoutName, tag.Name())
+		}
+		return
+	}
+
+	if (layout == amppb.AmpLayout_FIXED || layout == amppb.AmpLayout_FIXED_HEIGHT || layout == amppb.AmpLayout_RESPONSIVE) && !height.isSet {
+		addError(amppb.ValidationError_ATTR_VALUE_REQUIRED_BY_LAYOUT, "height is required by layout=%s", layoutName)
+		return
+	}
+	if layout == amppb.AmpLayout_FIXED_HEIGHT && width.isSet && !width.isAuto {
+		// the width is ignored by fixed-height
+		setTagAttr(tag, "width", "auto")
+		conv.addAMPError(&AMPError{
+			Type:                AMPRemoveAttr,
+			Code:                amppb.ValidationError_ATTR_VALUE_REQUIRED_BY_LAYOUT,
+			token:               tag,
+			validatorSourceSpec: tagSpec,
+			cause:               fmt.Errorf("width must be auto for layout=%s", layoutName),
+		})
+	}
+	if layout == amppb.AmpLayout_FIXED || layout == amppb.AmpLayout_RESPONSIVE {
+		if !width.isSet || width.isAuto {
+			addError(amppb.ValidationError_ATTR_VALUE_REQUIRED_BY_LAYOUT, "width is required by layout=%s", layoutName)
+			return
+		}
+	}
+	if layout == amppb.AmpLayout_RESPONSIVE && width.unit != height.unit {
+		addError(amppb.ValidationError_INCONSISTENT_UNITS_FOR_WIDTH_AND_HEIGHT, "width is %s, height is %s", width.unit, height.unit)
+		return
+	}
+
+	if tag.HasAttr("heights") && layout != amppb.AmpLayout_RESPONSIVE {
+		// heights is ignored except responsive
+		tag.RemoveAttr("heights")
+		code := amppb.ValidationError_ATTR_DISALLOWED_BY_SPECIFIED_LAYOUT
+		if inputLayout == amppb.AmpLayout_UNKNOWN {
+			code = amppb.ValidationError_ATTR_DISALLOWED_BY_IMPLIED_LAYOUT
+		}
+		conv.addAMPError(&AMPError{
+			Type:                AMPRemoveAttr,
+			Code:                code,
+			token:               tag,
+			validatorSourceSpec: tagSpec,
+			cause:               fmt.Errorf("heights is not allowed for layout=%s", layoutName),
+		})
+	}
+}
+
+// LayoutPolicy chooses the layout attr of the converted media tag, e.g. "responsive".
+// tag is the source tag, width and height are the intrinsic size of the media, 0 if unknown.
+// returning empty string means the built-in policy.
+type LayoutPolicy func(tag html2html.Tag, width, height int) string
+
+// smallMediaSize is the size in pixels, the media smaller than it is an icon or an emoji. it should not be stretched.
+const smallMediaSize = 64
+
+// mediaLayout chooses the layout of the media tag by the layout policy.
+func (conv *Converter) mediaLayout(tag html2html.Tag, width, height int) amppb.AmpLayout_Layout {
+	if conv.layoutPolicy != nil {
+		if layout, ok := parseAMPLayout(conv.layoutPolicy(tag, width, height)); ok && layout != amppb.AmpLayout_UNKNOWN {
+			return layout
+		}
+	}
+
+	if conv.isInFlexContainer(tag) {
+		return amppb.AmpLayout_FLEX_ITEM
+	}
+
+	attrWidth := parseCSSLength(tag.GetAttr("width"), false)
+	attrHeight := parseCSSLength(tag.GetAttr("height"), false)
+	if attrHeight.isSet && attrHeight.isValid && !attrWidth.isSet {
+		return amppb.AmpLayout_FIXED_HEIGHT
+	}
+	if attrWidth.isSet && attrWidth.isValid && attrWidth.unit == "px" {
+		width = int(attrWidth.numeral)
+	}
+	if attrHeight.isSet && attrHeight.isValid && attrHeight.unit == "px" {
+		height = int(attrHeight.numeral)
+	}
+	if 0 < width && width <= smallMediaSize && 0 < height && height <= smallMediaSize {
+		return amppb.AmpLayout_FIXED
+	}
+
+	return amppb.AmpLayout_RESPONSIVE
+}
+
+// isInFlexContainer reports whether the parent of tag has display: flex in its style attr.
+// the style attr of the parent is already converted to the class.
+// the parent made flex by the stylesheets, e.g. .row{display:flex}, is not detected, the selectors are not matched to the tags.
+func (conv *Converter) isInFlexContainer(tag html2html.Tag) bool {
+	parent := tag.Parent()
+	if parent == nil || parent.IsDocumentRoot() {
+		return false
+	}
+	classAttr := parent.GetAttr("class")
+	if classAttr == nil {
+		return false
+	}
+	for _, className := range strings.Fields(classAttr.Value) {
+		if conv.flexContainerClasses[className] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setMediaLayout sets layout, width and height attrs of ampTag which is converted from tag.
+// width and height are the intrinsic size of the media, the size in the attrs of tag is preferred for fixed sizes.
+func (conv *Converter) setMediaLayout(tag, ampTag html2html.Tag, width, height int) {
+	layout := conv.mediaLayout(tag, width, height)
+
+	sizeAttr := func(key string, intrinsic int) string {
+		if attr := tag.GetAttr(key); attr != nil {
+			if length := parseCSSLength(attr, false); length.isValid {
+				return attr.Value
+			}
+		}
+		return strconv.Itoa(intrinsic)
+	}
+
+	switch layout {
+	case amppb.AmpLayout_RESPONSIVE:
+		// the intrinsic size keeps the aspect ratio
+		setTagAttr(ampTag, "width", strconv.Itoa(width))
+		setTagAttr(ampTag, "height", strconv.Itoa(height))
+	case amppb.AmpLayout_FIXED, amppb.AmpLayout_FLEX_ITEM:
+		setTagAttr(ampTag, "width", sizeAttr("width", width))
+		setTagAttr(ampTag, "height", sizeAttr("height", height))
+	case amppb.AmpLayout_FIXED_HEIGHT:
+		setTagAttr(ampTag, "width", "auto")
+		setTagAttr(ampTag, "height", sizeAttr("height", height))
+	default:
+		// fill, container, nodisplay
+		ampTag.RemoveAttr("width")
+		ampTag.RemoveAttr("height")
+	}
+	setTagAttr(ampTag, "layout", ampLayoutAttrValue(layout))
+}
@@ -0,0 +1,221 @@
+package amphtml
+
+import (
+	"testing"
+
+	"github.com/favclip/ampassador/amppb"
+	"github.com/favclip/html2html"
+)
+
+func TestParseCSSLength(t *testing.T) {
+	specs := []struct {
+		value     string
+		allowAuto bool
+		expected  cssLength
+	}{
+		{"100", false, cssLength{isSet: true, isValid: true, numeral: 100, unit: "px"}},
+		{"1.5em", false, cssLength{isSet: true, isValid: true, numeral: 1.5, unit: "em"}},
+		{".5em", false, cssLength{isSet: true, isValid: true, numeral: 0.5, unit: "em"}},
+		{"1.", false, cssLength{isSet: true, isValid: true, numeral: 1, unit: "px"}},
+		{"10PX", false, cssLength{isSet: true, isValid: true, numeral: 10, unit: "px"}},
+		{"1.5.5", false, cssLength{isSet: true, unit: "px"}},
+		{".", false, cssLength{isSet: true, unit: "px"}},
+		{"auto", true, cssLength{isSet: true, isValid: true, isAuto: true, unit: "px"}},
+		{"auto", false, cssLength{isSet: true, isAuto: true, unit: "px"}},
+		{"100%", true, cssLength{isSet: true, unit: "px"}},
+		{"-1", true, cssLength{isSet: true, unit: "px"}},
+	}
+	for _, spec := range specs {
+		if v := parseCSSLength(&html2html.Attr{Key: "width", Value: spec.value}, spec.allowAuto); v != spec.expected {
+			t.Error(spec.value, "unexpected", v)
+		}
+	}
+
+	if v := parseCSSLength(nil, false); v.isSet || !v.isValid {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestParseAMPLayout(t *testing.T) {
+	specs := []struct {
+		value    string
+		expected amppb.AmpLayout_Layout
+		ok       bool
+	}{
+		{"", amppb.AmpLayout_UNKNOWN, true},
+		{"responsive", amppb.AmpLayout_RESPONSIVE, true},
+		{"fixed-height", amppb.AmpLayout_FIXED_HEIGHT, true},
+		{"FLEX-ITEM", amppb.AmpLayout_FLEX_ITEM, true},
+		{"unknown", amppb.AmpLayout_UNKNOWN, false},
+		{"fluid", amppb.AmpLayout_UNKNOWN, false},
+	}
+	for _, spec := range specs {
+		if v, ok := parseAMPLayout(spec.value); v != spec.expected || ok != spec.ok {
+			t.Error(spec.value, "unexpected", v, ok)
+		}
+	}
+
+	if v := ampLayoutAttrValue(amppb.AmpLayout_FIXED_HEIGHT); v != "fixed-height" {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestCalculateLayout(t *testing.T) {
+	length := func(value string) cssLength {
+		if value == "" {
+			return parseCSSLength(nil, true)
+		}
+		return parseCSSLength(&html2html.Attr{Value: value}, true)
+	}
+
+	specs := []struct {
+		width    string
+		height   string
+		sizes    bool
+		expected amppb.AmpLayout_Layout
+	}{
+		{"", "", false, amppb.AmpLayout_CONTAINER},
+		{"", "100", false, amppb.AmpLayout_FIXED_HEIGHT},
+		{"auto", "100", false, amppb.AmpLayout_FIXED_HEIGHT},
+		{"200", "100", false, amppb.AmpLayout_FIXED},
+		{"200", "100", true, amppb.AmpLayout_RESPONSIVE},
+		{"200", "", false, amppb.AmpLayout_FIXED},
+	}
+	for _, spec := range specs {
+		if v := calculateLayout(amppb.AmpLayout_UNKNOWN, length(spec.width), length(spec.height), spec.sizes, false); v != spec.expected {
+			t.Error(spec, "unexpected", v)
+		}
+	}
+
+	if v := calculateLayout(amppb.AmpLayout_FILL, length(""), length(""), false, false); v != amppb.AmpLayout_FILL {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestFitAMPLayout(t *testing.T) {
+	conv := newTestConverter(t)
+	tagSpec := findTestTagSpec(t, conv, "AMP-IMG")
+
+	specs := []struct {
+		attrs         map[string]string
+		expectedCode  amppb.ValidationError_Code
+		expectedWidth string
+	}{
+		{map[string]string{"width": "1200", "height": "800", "layout": "responsive"}, amppb.ValidationError_UNKNOWN_CODE, "1200"},
+		{map[string]string{"width": "1200", "height": "800"}, amppb.ValidationError_UNKNOWN_CODE, "1200"},
+		{map[string]string{}, amppb.ValidationError_IMPLIED_LAYOUT_INVALID, ""},
+		{map[string]string{"layout": "container"}, amppb.ValidationError_SPECIFIED_LAYOUT_INVALID, ""},
+		{map[string]string{"layout": "foo"}, amppb.ValidationError_INVALID_ATTR_VALUE, ""},
+		{map[string]string{"width": "100%", "height": "800"}, amppb.ValidationError_INVALID_ATTR_VALUE, "100%"},
+		{map[string]string{"width": "1200", "layout": "responsive"}, amppb.ValidationError_ATTR_VALUE_REQUIRED_BY_LAYOUT, "1200"},
+		{map[string]string{"width": "12em", "height": "800", "layout": "responsive"}, amppb.ValidationError_INCONSISTENT_UNITS_FOR_WIDTH_AND_HEIGHT, "12em"},
+		{map[string]string{"width": "12EM", "height": "8em", "layout": "responsive"}, amppb.ValidationError_UNKNOWN_CODE, "12EM"},
+		// width=auto is only for fixed-height
+		{map[string]string{"width": "auto", "height": "800"}, amppb.ValidationError_UNKNOWN_CODE, "auto"},
+		{map[string]string{"width": "auto", "height": "800", "layout": "responsive"}, amppb.ValidationError_INVALID_ATTR_VALUE, "auto"},
+		{map[string]string{"width": "auto", "height": "800", "layout": "fill"}, amppb.ValidationError_INVALID_ATTR_VALUE, "auto"},
+		{map[string]string{"width": "auto", "height": "800", "layout": "flex-item"}, amppb.ValidationError_INVALID_ATTR_VALUE, "auto"},
+		// sizes and heights
+		{map[string]string{"width": "1200", "height": "800", "sizes": "(min-width: 650px) 50vw, calc(100vw - 16px)"}, amppb.ValidationError_UNKNOWN_CODE, "1200"},
+		{map[string]string{"width": "1200", "height": "800", "heights": "(min-width: 500px) 200px, 80%"}, amppb.ValidationError_UNKNOWN_CODE, "1200"},
+		{map[string]string{"width": "1200", "height": "800", "sizes": "50%"}, amppb.ValidationError_INVALID_ATTR_VALUE, "1200"},
+		{map[string]string{"width": "1200", "height": "800", "heights": "min-width 200px"}, amppb.ValidationError_INVALID_ATTR_VALUE, "1200"},
+		// repaired
+		{map[string]string{"width": "1200", "height": "800", "layout": "fixed-height"}, amppb.ValidationError_ATTR_VALUE_REQUIRED_BY_LAYOUT, "auto"},
+	}
+	for _, spec := range specs {
+		tag := html2html.CreateElement("amp-img")
+		for key, value := range spec.attrs {
+			tag.AddAttr(key, value)
+		}
+
+		conv.fitAMPLayout(tagSpec, tag)
+
+		ampErrors, code := flushAMPErrors(conv)
+		if code != spec.expectedCode {
+			t.Error(spec.attrs, "unexpected", ampErrors)
+		}
+		var width string
+		if attr := tag.GetAttr("width"); attr != nil {
+			width = attr.Value
+		}
+		if width != spec.expectedWidth {
+			t.Error(spec.attrs, "unexpected", width)
+		}
+	}
+}
+
+func TestMediaLayout(t *testing.T) {
+	conv := newTestConverter(t)
+	conv.flexContainerClasses["h2a-div-flex"] = true
+
+	specs := []struct {
+		attrs       map[string]string
+		parentClass string
+		width       int
+		height      int
+		expected    amppb.AmpLayout_Layout
+	}{
+		{map[string]string{}, "", 1200, 800, amppb.AmpLayout_RESPONSIVE},
+		{map[string]string{}, "", 16, 16, amppb.AmpLayout_FIXED},
+		{map[string]string{"width": "20", "height": "20"}, "", 1200, 800, amppb.AmpLayout_FIXED},
+		{map[string]string{"height": "100"}, "", 1200, 800, amppb.AmpLayout_FIXED_HEIGHT},
+		{map[string]string{}, "h2a-div-flex", 1200, 800, amppb.AmpLayout_FLEX_ITEM},
+		// .row{display:flex} in the stylesheet is not detected, only the style attrs are
+		{map[string]string{}, "row", 1200, 800, amppb.AmpLayout_RESPONSIVE},
+		{map[string]string{}, "", 0, 0, amppb.AmpLayout_RESPONSIVE},
+	}
+	for _, spec := range specs {
+		parent := html2html.CreateElement("div")
+		if spec.parentClass != "" {
+			parent.AddAttr("class", spec.parentClass)
+		}
+		tag := html2html.CreateElement("img")
+		for key, value := range spec.attrs {
+			tag.AddAttr(key, value)
+		}
+		parent.AddChildTokens(tag)
+
+		if v := conv.mediaLayout(tag, spec.width, spec.height); v != spec.expected {
+			t.Error(spec.attrs, spec.parentClass, spec.width, spec.height, "unexpected", v)
+		}
+	}
+
+	conv.layoutPolicy = func(tag html2html.Tag, width, height int) string {
+		if tag.HasAttr("data-fill") {
+			return "fill"
+		}
+		return ""
+	}
+	tag := html2html.CreateElement("img")
+	tag.AddAttr("data-fill", "")
+	if v := conv.mediaLayout(tag, 1200, 800); v != amppb.AmpLayout_FILL {
+		t.Error("unexpected", v)
+	}
+	if v := conv.mediaLayout(html2html.CreateElement("img"), 1200, 800); v != amppb.AmpLayout_RESPONSIVE {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestIsValidSourceSizes(t *testing.T) {
+	specs := []struct {
+		value        string
+		allowPercent bool
+		expected     bool
+	}{
+		{"100vw", false, true},
+		{"(min-width: 650px) 50vw, 100vw", false, true},
+		{"screen and (max-width: 480px) 100vw, 320px", false, true},
+		{"(min-width: 650px) calc(50vw - 10px), 100vw", false, true},
+		{"(min-width: 500px) 200px, 80%", true, true},
+		{"80%", false, false},
+		{"100vw,", false, false},
+		{"min-width 50vw", false, false},
+		{"foo", false, false},
+	}
+	for _, spec := range specs {
+		if v := isValidSourceSizes(spec.value, spec.allowPercent); v != spec.expected {
+			t.Error(spec.value, "unexpected", v)
+		}
+	}
+}
@@ -12,6 +12,9 @@ import (
 type wrappedRules struct {
 	targetHTMLFormat amppb.TagSpec_HtmlFormat
 	rules            *amppb.ValidatorRules
+
+	// href of the whitelisted font providers. nil if the rules don't have it
+	fontProviderURLRegexp *regexp.Regexp
 }
 
 type attrSpecEx amppb.AttrSpec
@@ -26,6 +29,10 @@ func newWrappedRules(text string) (*wrappedRules, error) {
 		targetHTMLFormat: amppb.TagSpec_AMP,
 		rules:            rules,
 	}
+	w.fontProviderURLRegexp, err = w.compileFontProviderURLRegexp()
+	if err != nil {
+		return nil, err
+	}
 
 	return w, nil
 }
@@ -35,17 +42,8 @@ func (w *wrappedRules) countTagSpecs(tagName string) int {
 
 	count := 0
 	for _, tagSpec := range w.rules.GetTags() {
-		if htmlFormats := tagSpec.GetHtmlFormat(); len(htmlFormats) != 0 {
-			found := false
-			for _, htmlFormat := range htmlFormats {
-				if htmlFormat == w.targetHTMLFormat {
-					found = true
-					break
-				}
-			}
-			if !found {
-				continue
-			}
+		if !w.isTargetHTMLFormat(tagSpec) {
+			continue
 		}
 
 		if strings.ToLower(tagSpec.GetTagName()) == tagName {
@@ -56,17 +54,134 @@ func (w *wrappedRules) countTagSpecs(tagName string) int {
 	return count
 }
 
+func (w *wrappedRules) isTargetHTMLFormat(tagSpec *amppb.TagSpec) bool {
+	htmlFormats := tagSpec.GetHtmlFormat()
+	if len(htmlFormats) == 0 {
+		return true
+	}
+	for _, htmlFormat := range htmlFormats {
+		if htmlFormat == w.targetHTMLFormat {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findAMPCustomStyleSpec returns the TagSpec of <style amp-custom> for the target html format.
+func (w *wrappedRules) findAMPCustomStyleSpec() *amppb.TagSpec {
+	for _, tagSpec := range w.rules.GetTags() {
+		if strings.ToLower(tagSpec.GetTagName()) != "style" || !w.isTargetHTMLFormat(tagSpec) {
+			continue
+		}
+		for _, attrSpec := range tagSpec.GetAttrs() {
+			if attrSpec.GetName() == "amp-custom" {
+				return tagSpec
+			}
+		}
+	}
+
+	return nil
+}
+
+// findTagSpecByName returns the TagSpec which has specName for the target html format.
+func (w *wrappedRules) findTagSpecByName(specName string) *amppb.TagSpec {
+	for _, tagSpec := range w.rules.GetTags() {
+		if tagSpec.GetSpecName() == specName && w.isTargetHTMLFormat(tagSpec) {
+			return tagSpec
+		}
+	}
+
+	return nil
+}
+
+func (w *wrappedRules) compileFontProviderURLRegexp() (*regexp.Regexp, error) {
+	tagSpec := w.findTagSpecByName("link rel=stylesheet for fonts")
+	for _, attrSpec := range tagSpec.GetAttrs() {
+		if attrSpec.GetName() != "href" || attrSpec.ValueRegex == nil {
+			continue
+		}
+		return regexp.Compile("^(?:" + attrSpec.GetValueRegex() + ")$")
+	}
+
+	return nil, nil
+}
+
+// isFontProviderURL reports whether href is a stylesheet of the whitelisted font providers.
+func (w *wrappedRules) isFontProviderURL(href string) bool {
+	if w.fontProviderURLRegexp == nil {
+		return false
+	}
+
+	return w.fontProviderURLRegexp.MatchString(href)
+}
+
+// extensionScriptURL returns src of the script of the extension name, e.g. https://cdn.ampproject.org/v0/amp-form-0.1.js.
+// the newest version in the extension spec is used, "latest" if the rules don't have the extension spec.
+// it returns "" if the rules don't have the runtime script.
+func (w *wrappedRules) extensionScriptURL(name string) string {
+	runtimeURL := ""
+	for _, attrSpec := range w.findTagSpecByName("amphtml engine v0.js script").GetAttrs() {
+		if attrSpec.GetName() == "src" {
+			runtimeURL = attrSpec.GetValue()
+		}
+	}
+	if !strings.HasSuffix(runtimeURL, ".js") {
+		return ""
+	}
+
+	version := "latest"
+	for _, tagSpec := range w.rules.GetTags() {
+		if tagSpec.GetExtensionSpec().GetName() != name || !w.isTargetHTMLFormat(tagSpec) {
+			continue
+		}
+		extensionSpec := tagSpec.GetExtensionSpec()
+		deprecated := make(map[string]bool)
+		for _, v := range extensionSpec.GetDeprecatedVersions() {
+			deprecated[v] = true
+		}
+		for _, v := range extensionSpec.GetAllowedVersions() {
+			if v == "latest" || deprecated[v] {
+				continue
+			}
+			// the allowed versions are in ascending order
+			version = v
+		}
+	}
+
+	// https://cdn.ampproject.org/v0.js -> https://cdn.ampproject.org/v0/amp-form-0.1.js
+	return strings.TrimSuffix(runtimeURL, ".js") + "/" + name + "-" + version + ".js"
+}
+
 func (w *wrappedRules) getAttrSpecs(tagSpec *amppb.TagSpec) []*amppb.AttrSpec {
 	var resultList []*amppb.AttrSpec
 	resultList = append(resultList, tagSpec.GetAttrs()...)
 	for _, attrListName := range tagSpec.GetAttrLists() {
 		resultList = append(resultList, w.findAttrList(attrListName).GetAttrs()...)
 	}
+	if tagSpec.GetAmpLayout() != nil {
+		// width, height, layout... are implied by amp_layout
+		resultList = append(resultList, w.findAttrList("$AMP_LAYOUT_ATTRS").GetAttrs()...)
+	}
 	resultList = append(resultList, w.findAttrList("$GLOBAL_ATTRS").GetAttrs()...)
 
 	return resultList
 }
 
+// isImplicitAttr reports whether the attr is implied by the element of tagSpec, e.g. role and tabindex of <button>.
+func (w *wrappedRules) isImplicitAttr(tagSpec *amppb.TagSpec, attrName string) bool {
+	if tagSpec == nil {
+		return false
+	}
+	for _, attrSpec := range w.getAttrSpecs(tagSpec) {
+		if attrSpec.GetName() == attrName && attrSpec.GetImplicit() {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (w *wrappedRules) findAttrList(attrListName string) *amppb.AttrList {
 	for _, attrList := range w.rules.GetAttrLists() {
 		if attrList.GetName() == attrListName {
@@ -77,6 +192,40 @@ func (w *wrappedRules) findAttrList(attrListName string) *amppb.AttrList {
 	return nil
 }
 
+// mandatoryOneofGroups groups the attr specs by mandatory_oneof, in the order of the first appearance.
+func mandatoryOneofGroups(attrSpecs []*amppb.AttrSpec) [][]*amppb.AttrSpec {
+	var groups [][]*amppb.AttrSpec
+	indexes := make(map[string]int)
+	for _, attrSpec := range attrSpecs {
+		if attrSpec.MandatoryOneof == nil {
+			continue
+		}
+		key := attrSpec.GetMandatoryOneof()
+		if i, ok := indexes[key]; ok {
+			groups[i] = append(groups[i], attrSpec)
+			continue
+		}
+		indexes[key] = len(groups)
+		groups = append(groups, []*amppb.AttrSpec{attrSpec})
+	}
+
+	return groups
+}
+
+// presentAttrName returns the name of the attr for attrSpec in tag, it may be one of the alternative names.
+func presentAttrName(tag html2html.Tag, attrSpec *amppb.AttrSpec) (string, bool) {
+	if tag.HasAttr(attrSpec.GetName()) {
+		return attrSpec.GetName(), true
+	}
+	for _, altName := range attrSpec.GetAlternativeNames() {
+		if tag.HasAttr(altName) {
+			return altName, true
+		}
+	}
+
+	return "", false
+}
+
 func isAttrSpecMatch(attrSpec *amppb.AttrSpec, attr *html2html.Attr) bool {
 	if attr == nil {
 		return false
@@ -85,6 +234,10 @@ func isAttrSpecMatch(attrSpec *amppb.AttrSpec, attr *html2html.Attr) bool {
 	if attrSpec.GetName() != attr.Key {
 		return false
 	}
+	if attrSpec.GetImplicit() {
+		// any value is allowed, the element has it by itself
+		return true
+	}
 
 	if attrSpec.Value != nil && attr.Value != attrSpec.GetValue() {
 		return false
@@ -116,7 +269,7 @@ func isAttrSpecMatch(attrSpec *amppb.AttrSpec, attr *html2html.Attr) bool {
 		if err != nil {
 			panic(err)
 		}
-		if !re.MatchString(attr.Value) {
+		if re.MatchString(attr.Value) {
 			return false
 		}
 	}
@@ -145,3 +298,31 @@ func isAttrSpecMatch(attrSpec *amppb.AttrSpec, attr *html2html.Attr) bool {
 
 	return true
 }
+
+// mandatoryAlternatives returns the TagSpecs for the target html format which share the mandatory_alternatives name, in the order of the rules.
+func (w *wrappedRules) mandatoryAlternatives(name string) []*amppb.TagSpec {
+	var tagSpecs []*amppb.TagSpec
+	for _, tagSpec := range w.rules.GetTags() {
+		if tagSpec.MandatoryAlternatives == nil || tagSpec.GetMandatoryAlternatives() != name || !w.isTargetHTMLFormat(tagSpec) {
+			continue
+		}
+		tagSpecs = append(tagSpecs, tagSpec)
+	}
+
+	return tagSpecs
+}
+
+// preferredAlternative returns the TagSpec which is created when no alternative is present.
+// the spec named after the group is preferred, the others are the old variants.
+func preferredAlternative(name string, tagSpecs []*amppb.TagSpec) *amppb.TagSpec {
+	for _, tagSpec := range tagSpecs {
+		if tagSpec.GetSpecName() == name {
+			return tagSpec
+		}
+	}
+	if len(tagSpecs) == 0 {
+		return nil
+	}
+
+	return tagSpecs[len(tagSpecs)-1]
+}
@@ -0,0 +1,103 @@
+package amphtml
+
+import (
+	"testing"
+
+	"github.com/favclip/ampassador/amppb"
+	"github.com/favclip/html2html"
+)
+
+func TestIsFontProviderURL(t *testing.T) {
+	rules := loadTestRules(t)
+
+	specs := []struct {
+		href     string
+		expected bool
+	}{
+		{"https://fonts.googleapis.com/css?family=Roboto", true},
+		{"https://fonts.googleapis.com/icon?family=Material+Icons", true},
+		{"https://maxcdn.bootstrapcdn.com/font-awesome/4.7.0/css/font-awesome.min.css", true},
+		{"https://cloud.typography.com/123/456/css/fonts.css", true},
+		{"http://fonts.googleapis.com/css?family=Roboto", false},
+		{"https://example.com/css?u=https://fonts.googleapis.com/css?family=Roboto", false},
+		{"https://example.com/style.css", false},
+	}
+	for _, spec := range specs {
+		if v := rules.isFontProviderURL(spec.href); v != spec.expected {
+			t.Error(spec.href, "unexpected", v)
+		}
+	}
+}
+
+func TestIsAttrSpecMatch_blacklistedValueRegex(t *testing.T) {
+	str := func(s string) *string { return &s }
+	attrSpec := &amppb.AttrSpec{
+		Name:                  str("href"),
+		BlacklistedValueRegex: str("__amp_source_origin"),
+	}
+
+	if !isAttrSpecMatch(attrSpec, &html2html.Attr{Key: "href", Value: "https://example.com/"}) {
+		t.Error("the value which doesn't match to blacklisted_value_regex must be matched")
+	}
+	if isAttrSpecMatch(attrSpec, &html2html.Attr{Key: "href", Value: "https://example.com/?__amp_source_origin=foo"}) {
+		t.Error("the value which matches to blacklisted_value_regex must not be matched")
+	}
+}
+
+func TestMandatoryOneofGroups(t *testing.T) {
+	str := func(s string) *string { return &s }
+	attrSpecs := []*amppb.AttrSpec{
+		{Name: str("src"), MandatoryOneof: str("['src', 'srcdoc']")},
+		{Name: str("frameborder")},
+		{Name: str("action"), MandatoryOneof: str("['action', 'action-xhr']")},
+		{Name: str("srcdoc"), MandatoryOneof: str("['src', 'srcdoc']")},
+	}
+
+	groups := mandatoryOneofGroups(attrSpecs)
+	if len(groups) != 2 {
+		t.Fatal("unexpected", groups)
+	}
+	if len(groups[0]) != 2 || groups[0][0].GetName() != "src" || groups[0][1].GetName() != "srcdoc" {
+		t.Error("unexpected", groups[0])
+	}
+	if len(groups[1]) != 1 || groups[1][0].GetName() != "action" {
+		t.Error("unexpected", groups[1])
+	}
+}
+
+func TestMandatoryAlternatives(t *testing.T) {
+	rules := loadTestRules(t)
+
+	tagSpecs := rules.mandatoryAlternatives("head > style[amp-boilerplate]")
+	if len(tagSpecs) != 2 {
+		t.Fatal("unexpected", len(tagSpecs))
+	}
+	if v := preferredAlternative("head > style[amp-boilerplate]", tagSpecs); v.GetSpecName() != "head > style[amp-boilerplate]" {
+		t.Error("unexpected", v.GetSpecName())
+	}
+	if v := preferredAlternative("unknown", nil); v != nil {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestExtensionScriptURL(t *testing.T) {
+	rules := loadTestRules(t)
+
+	if v := rules.extensionScriptURL("amp-form"); v != "https://cdn.ampproject.org/v0/amp-form-latest.js" {
+		t.Error("unexpected", v)
+	}
+
+	str := func(s string) *string { return &s }
+	rules.rules.Tags = append(rules.rules.Tags, &amppb.TagSpec{
+		TagName:  str("SCRIPT"),
+		SpecName: str("amp-form extension .js script"),
+		ExtensionSpec: &amppb.ExtensionSpec{
+			Name:               str("amp-form"),
+			AllowedVersions:    []string{"0.1", "0.2", "latest"},
+			DeprecatedVersions: []string{"0.2"},
+		},
+	})
+	if v := rules.extensionScriptURL("amp-form"); v != "https://cdn.ampproject.org/v0/amp-form-0.1.js" {
+		t.Error("unexpected", v)
+	}
+}
@@ -0,0 +1,250 @@
+package amphtml
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+
+	"github.com/favclip/html2html"
+)
+
+type ImagePlaceholderMode int
+
+const (
+	ImagePlaceholderNone ImagePlaceholderMode = iota
+	ImagePlaceholderBlur
+	ImagePlaceholderColor
+)
+
+// placeholderMaxSize is the longest side of the blurred preview in pixels.
+const placeholderMaxSize = 16
+
+// placeholderMaxDecodePixels is the largest image decoded for the placeholder, the decoded image takes 4 bytes per pixel.
+const placeholderMaxDecodePixels = 4096 * 4096
+
+var errImageTooLarge = errors.New("image is too large to decode")
+
+type ImagePlaceholder struct {
+	DataURI       string // tiny blurred preview as data:image/png URI
+	DominantColor string // #rrggbb
+}
+
+// AMPImagePlaceholderFetcher is implemented by AMPImageStatsFetcher which can make a low quality image placeholder.
+type AMPImagePlaceholderFetcher interface {
+	ImagePlaceholder(ctx context.Context, imageURL *url.URL) (*ImagePlaceholder, error)
+}
+
+// AMPImageDataFetcher is implemented by AMPImageStatsFetcher which can return the image data with its size.
+// the placeholder is made from the data, so the image is fetched just once.
+type AMPImageDataFetcher interface {
+	ImageData(ctx context.Context, imageURL *url.URL) (*url.URL, []byte, int, int, error) // modifiedURL, data, width, height
+}
+
+// decodeImage decodes the image in b. the size is checked before decoding, it returns errImageTooLarge for the huge image.
+func decodeImage(b []byte) (image.Image, error) {
+	width, height, _, err := decodeImageSize(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if placeholderMaxDecodePixels < width*height {
+		return nil, errImageTooLarge
+	}
+
+	switch {
+	case bytes.HasPrefix(b, []byte("\xff\xd8")):
+		return jpeg.Decode(bytes.NewReader(b))
+	case bytes.HasPrefix(b, []byte("\x89PNG\r\n\x1a\n")):
+		return png.Decode(bytes.NewReader(b))
+	case bytes.HasPrefix(b, []byte("GIF87a")), bytes.HasPrefix(b, []byte("GIF89a")):
+		return gif.Decode(bytes.NewReader(b))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err == image.ErrFormat {
+		return nil, ErrUnknownImageFormat
+	}
+	return img, err
+}
+
+func makeImagePlaceholder(src image.Image) (*ImagePlaceholder, error) {
+	small := shrinkImage(src, placeholderMaxSize)
+	blurred := boxBlurImage(small)
+
+	buf := bytes.NewBufferString("")
+	err := png.Encode(buf, blurred)
+	if err != nil {
+		return nil, err
+	}
+
+	c := averageColor(small)
+
+	return &ImagePlaceholder{
+		DataURI:       "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+		DominantColor: fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+	}, nil
+}
+
+// shrinkImage downscales src by averaging the source pixels covered by each destination pixel.
+func shrinkImage(src image.Image, maxSize int) *image.NRGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	dstW, dstH := srcW, srcH
+	if maxSize < srcW || maxSize < srcH {
+		if srcH < srcW {
+			dstW, dstH = maxSize, srcH*maxSize/srcW
+		} else {
+			dstW, dstH = srcW*maxSize/srcH, maxSize
+		}
+	}
+	if dstW < 1 {
+		dstW = 1
+	}
+	if dstH < 1 {
+		dstH = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for dy := 0; dy < dstH; dy++ {
+		y0 := bounds.Min.Y + dy*srcH/dstH
+		y1 := bounds.Min.Y + (dy+1)*srcH/dstH
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dstW; dx++ {
+			x0 := bounds.Min.X + dx*srcW/dstW
+			x1 := bounds.Min.X + (dx+1)*srcW/dstW
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(dx, dy, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+
+	return dst
+}
+
+// boxBlurImage applies 3x3 box blur.
+func boxBlurImage(src *image.NRGBA) *image.NRGBA {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			var r, g, b, a, n uint32
+			for ky := -1; ky <= 1; ky++ {
+				for kx := -1; kx <= 1; kx++ {
+					p := image.Pt(x+kx, y+ky)
+					if !p.In(bounds) {
+						continue
+					}
+					c := src.NRGBAAt(p.X, p.Y)
+					r += uint32(c.R)
+					g += uint32(c.G)
+					b += uint32(c.B)
+					a += uint32(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+
+	return dst
+}
+
+func averageColor(src *image.NRGBA) color.NRGBA {
+	bounds := src.Bounds()
+	var r, g, b, n uint64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := src.NRGBAAt(x, y)
+			if c.A == 0 {
+				continue
+			}
+			r += uint64(c.R)
+			g += uint64(c.G)
+			b += uint64(c.B)
+			n++
+		}
+	}
+	if n == 0 {
+		return color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	}
+
+	return color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: 0xff}
+}
+
+// addImagePlaceholder adds the placeholder to altTag. it is made from imgData if the image is fetched already,
+// otherwise the image is fetched by AMPImagePlaceholderFetcher.
+// the placeholder is optional, it is skipped if the image can't be fetched or decoded.
+// the reason is reported as a warning, except the formats which can't be decoded in pure Go, e.g. svg or webp.
+func (conv *Converter) addImagePlaceholder(ctx context.Context, altTag html2html.Tag, imgURL *url.URL, imgData []byte) {
+	if conv.imagePlaceholderMode == ImagePlaceholderNone {
+		return
+	}
+
+	var placeholder *ImagePlaceholder
+	var err error
+	if imgData != nil {
+		var img image.Image
+		img, err = decodeImage(imgData)
+		if err == nil {
+			placeholder, err = makeImagePlaceholder(img)
+		}
+	} else {
+		fetcher, ok := conv.ampImageStatsFetcher.(AMPImagePlaceholderFetcher)
+		if !ok {
+			return
+		}
+		placeholder, err = fetcher.ImagePlaceholder(ctx, imgURL)
+	}
+	if errors.Is(err, ErrUnknownImageFormat) || errors.Is(err, ErrNoIntrinsicImageSize) {
+		return
+	} else if isFetchBlocked(err) {
+		conv.addAMPError(&AMPError{
+			Type:  AMPFetchBlocked,
+			token: altTag,
+			cause: err,
+		})
+		return
+	} else if err != nil {
+		conv.addAMPError(&AMPError{
+			Type:  AMPValidatorWarning,
+			token: altTag,
+			cause: fmt.Errorf("%s: the image placeholder is skipped: %v", imgURL, err),
+		})
+		return
+	}
+
+	switch conv.imagePlaceholderMode {
+	case ImagePlaceholderBlur:
+		placeholderTag := html2html.CreateElement("amp-img")
+		placeholderTag.AddAttr("placeholder", "")
+		placeholderTag.AddAttr("src", placeholder.DataURI)
+		placeholderTag.AddAttr("layout", "fill")
+		altTag.AddChildTokens(placeholderTag)
+	case ImagePlaceholderColor:
+		// style attr will be converted to class at ReplaceToAMPTag
+		altTag.AddAttr("style", "background-color:"+placeholder.DominantColor)
+	}
+}
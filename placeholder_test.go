@@ -0,0 +1,186 @@
+package amphtml
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/favclip/html2html"
+)
+
+func TestMakeImagePlaceholder(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			src.Set(x, y, color.RGBA{R: 0x20, G: 0x40, B: 0x80, A: 0xff})
+		}
+	}
+
+	placeholder, err := makeImagePlaceholder(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := placeholder.DominantColor; v != "#204080" {
+		t.Error("unexpected", v)
+	}
+	if !strings.HasPrefix(placeholder.DataURI, "data:image/png;base64,") {
+		t.Error("unexpected", placeholder.DataURI)
+	}
+
+	d, err := parseDataURI(placeholder.DataURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width, height, _, err := decodeImageSize(strings.NewReader(string(d.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width != placeholderMaxSize || height != placeholderMaxSize/2 {
+		t.Error("unexpected", width, height)
+	}
+}
+
+func TestDecodeImage(t *testing.T) {
+	b, err := ioutil.ReadFile("./fixture/with-image/cat.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := decodeImage(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := img.Bounds().Dx(); v != 1200 {
+		t.Error("unexpected", v)
+	}
+
+	_, err = decodeImage([]byte(`<svg width="10" height="10"></svg>`))
+	if err != ErrUnknownImageFormat {
+		t.Error("unexpected", err)
+	}
+
+	// only the header of 100000x100000 png, it must not be decoded
+	ihdr := []byte("IHDR\x00\x01\x86\xa0\x00\x01\x86\xa0\x08\x02\x00\x00\x00")
+	header := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"), ihdr...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(ihdr))
+	header = append(header, crc...)
+	_, err = decodeImage(header)
+	if err != errImageTooLarge {
+		t.Error("unexpected", err)
+	}
+}
+
+type errorImagePlaceholderFetcher struct {
+	called bool
+}
+
+func (f *errorImagePlaceholderFetcher) ImageSize(ctx context.Context, imageURL *url.URL) (*url.URL, int, int, error) {
+	return imageURL, 0, 0, errors.New("network error")
+}
+
+func (f *errorImagePlaceholderFetcher) ImageSrcSetAttr(ctx context.Context, imageURL *url.URL) (string, error) {
+	return "", nil
+}
+
+func (f *errorImagePlaceholderFetcher) ImagePlaceholder(ctx context.Context, imageURL *url.URL) (*ImagePlaceholder, error) {
+	f.called = true
+	return nil, errors.New("network error")
+}
+
+func TestConverter_addImagePlaceholder(t *testing.T) {
+	fetcher := &errorImagePlaceholderFetcher{}
+	conv := &Converter{
+		imagePlaceholderMode: ImagePlaceholderColor,
+		ampImageStatsFetcher: fetcher,
+	}
+	sinkURL, err := url.Parse("https://static.example.com/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the decoded data URI is used, the sink URL is not fetched
+	d, err := parseDataURI(testPNGDataURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := html2html.CreateElement("amp-img")
+	conv.addImagePlaceholder(context.Background(), tag, sinkURL, d.Data)
+	if fetcher.called {
+		t.Error("image must not be fetched")
+	}
+	if attr := tag.GetAttr("style"); attr == nil || !strings.HasPrefix(attr.Value, "background-color:#") {
+		t.Error("unexpected", tag.Attrs())
+	}
+
+	if len(conv.ampErrors) != 0 {
+		t.Error("unexpected", conv.ampErrors)
+	}
+
+	// the placeholder is skipped on error, it is reported
+	tag = html2html.CreateElement("amp-img")
+	conv.addImagePlaceholder(context.Background(), tag, sinkURL, nil)
+	if !fetcher.called {
+		t.Error("image must be fetched")
+	}
+	if tag.HasAttr("style") {
+		t.Error("unexpected", tag.Attrs())
+	}
+	if len(conv.ampErrors) != 1 || conv.ampErrors[0].Type != AMPValidatorWarning || !strings.Contains(conv.ampErrors[0].Error(), "network error") {
+		t.Error("unexpected", conv.ampErrors)
+	}
+
+	// broken image is reported too
+	conv.ampErrors = nil
+	tag = html2html.CreateElement("amp-img")
+	conv.addImagePlaceholder(context.Background(), tag, sinkURL, d.Data[:len(d.Data)-20])
+	if tag.HasAttr("style") || len(conv.ampErrors) != 1 || conv.ampErrors[0].Type != AMPValidatorWarning {
+		t.Error("unexpected", tag.Attrs(), conv.ampErrors)
+	}
+
+	// svg can't be decoded, it is expected
+	conv.ampErrors = nil
+	tag = html2html.CreateElement("amp-img")
+	conv.addImagePlaceholder(context.Background(), tag, sinkURL, []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`))
+	if tag.HasAttr("style") || len(conv.ampErrors) != 0 {
+		t.Error("unexpected", tag.Attrs(), conv.ampErrors)
+	}
+}
+
+func TestAMPImageModifier_fetchOnce(t *testing.T) {
+	d, err := parseDataURI(testPNGDataURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := 0
+	fileFetcher := func(ctx context.Context, targetURL *url.URL) (io.ReadCloser, error) {
+		fetched++
+		return ioutil.NopCloser(bytes.NewReader(d.Data)), nil
+	}
+	conv, err := NewConverter(WithFileFetcher(fileFetcher), WithImagePlaceholder(ImagePlaceholderColor))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag := html2html.CreateElement("img")
+	tag.AddAttr("src", "https://example.com/a.png")
+	altTag, err := ampImageModifier(context.Background(), conv, &AMPTag{SrcTag: "img", DestTag: "amp-img"}, tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched != 1 {
+		t.Error("image must be fetched once", fetched)
+	}
+	if attr := altTag.GetAttr("style"); attr == nil || !strings.HasPrefix(attr.Value, "background-color:#") {
+		t.Error("unexpected", altTag.Attrs())
+	}
+}
@@ -1,10 +1,11 @@
 package amphtml
 
 import (
-	"image"
+	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
 	"net/url"
-	"strconv"
 
 	"github.com/favclip/html2html"
 )
@@ -19,9 +20,13 @@ type AMPTag struct {
 	Modifier TagModifier
 }
 
-type TagModifier func(conv *Converter, ampTag *AMPTag, tag html2html.Tag) (html2html.Tag, error)
+// TagModifier converts tag to ampTag.DestTag. returning nil Tag without error removes the tag.
+type TagModifier func(ctx context.Context, conv *Converter, ampTag *AMPTag, tag html2html.Tag) (html2html.Tag, error)
 
-type FileFetcher func(targetURL *url.URL) (io.ReadCloser, error)
+type FileFetcher func(ctx context.Context, targetURL *url.URL) (io.ReadCloser, error)
+
+// AssetSink stores the data extracted from the document and returns the URL to refer it.
+type AssetSink func(ctx context.Context, mediaType string, data []byte) (*url.URL, error)
 
 func (list AMPTagList) isAMPTag(tag html2html.Tag) bool {
 	for _, ampTag := range list {
@@ -33,8 +38,8 @@ func (list AMPTagList) isAMPTag(tag html2html.Tag) bool {
 }
 
 type AMPImageStatsFetcher interface {
-	ImageSize(imageURL *url.URL) (*url.URL, int, int, error) // modifiedURL, width, height
-	ImageSrcSetAttr(imageURL *url.URL) (string, error)       // return value uses for <amp-img src=... srcset="{{Here!}}">
+	ImageSize(ctx context.Context, imageURL *url.URL) (*url.URL, int, int, error) // modifiedURL, width, height
+	ImageSrcSetAttr(ctx context.Context, imageURL *url.URL) (string, error)       // return value uses for <amp-img src=... srcset="{{Here!}}">
 }
 
 func init() {
@@ -49,26 +54,78 @@ type ampImageStatsFetcherImpl struct {
 	fileFetcher FileFetcher
 }
 
-func (a *ampImageStatsFetcherImpl) ImageSize(imageURL *url.URL) (*url.URL, int, int, error) {
-	data, err := a.fileFetcher(imageURL)
+func (a *ampImageStatsFetcherImpl) open(ctx context.Context, imageURL *url.URL) (io.ReadCloser, error) {
+	if imageURL.Scheme == "data" {
+		d, err := parseDataURI(imageURL.String())
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(d.Data)), nil
+	}
+
+	return a.fileFetcher(ctx, imageURL)
+}
+
+func (a *ampImageStatsFetcherImpl) ImageSize(ctx context.Context, imageURL *url.URL) (*url.URL, int, int, error) {
+	data, err := a.open(ctx, imageURL)
 	if err != nil {
 		return imageURL, 0, 0, err
 	}
 	defer data.Close()
 
-	config, _, err := image.DecodeConfig(data)
+	width, height, _, err := decodeImageSize(data)
 	if err != nil {
 		return imageURL, 0, 0, err
 	}
 
-	return imageURL, config.Width, config.Height, nil
+	return imageURL, width, height, nil
+}
+
+func (a *ampImageStatsFetcherImpl) ImageData(ctx context.Context, imageURL *url.URL) (*url.URL, []byte, int, int, error) {
+	data, err := a.open(ctx, imageURL)
+	if err != nil {
+		return imageURL, nil, 0, 0, err
+	}
+	defer data.Close()
+
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return imageURL, nil, 0, 0, err
+	}
+
+	width, height, _, err := decodeImageSize(bytes.NewReader(b))
+	if err != nil {
+		return imageURL, nil, 0, 0, err
+	}
+
+	return imageURL, b, width, height, nil
 }
 
-func (m *ampImageStatsFetcherImpl) ImageSrcSetAttr(imageURL *url.URL) (string, error) {
+func (m *ampImageStatsFetcherImpl) ImageSrcSetAttr(ctx context.Context, imageURL *url.URL) (string, error) {
 	return "", nil
 }
 
-func ampImageModifier(conv *Converter, ampTag *AMPTag, tag html2html.Tag) (html2html.Tag, error) {
+func (a *ampImageStatsFetcherImpl) ImagePlaceholder(ctx context.Context, imageURL *url.URL) (*ImagePlaceholder, error) {
+	data, err := a.open(ctx, imageURL)
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodeImage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return makeImagePlaceholder(img)
+}
+
+func ampImageModifier(ctx context.Context, conv *Converter, ampTag *AMPTag, tag html2html.Tag) (html2html.Tag, error) {
 	altTag := html2html.CreateElement(ampTag.DestTag)
 
 	for _, attr := range tag.Attrs() {
@@ -76,24 +133,53 @@ func ampImageModifier(conv *Converter, ampTag *AMPTag, tag html2html.Tag) (html2
 		case "alt":
 			altTag.AddAttr(attr.Key, attr.Value)
 		case "src":
-			imgURL, err := url.Parse(attr.Value)
-			if err != nil {
-				altTag.AddAttr(attr.Key, attr.Value)
-				continue
+			var imgURL *url.URL
+			var imgData []byte // fetched already, or decoded from data URI
+			var srcValue string
+			var width, height int
+			var err error
+			if isDataURI(attr.Value) {
+				imgURL, imgData, width, height, err = conv.dataURIImageSize(ctx, attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				srcValue = imgURL.String()
+			} else {
+				resolvedURL, err := conv.resolveURL(attr.Value)
+				if err != nil {
+					altTag.AddAttr(attr.Key, attr.Value)
+					continue
+				}
+
+				if dataFetcher, ok := conv.ampImageStatsFetcher.(AMPImageDataFetcher); ok && conv.imagePlaceholderMode != ImagePlaceholderNone {
+					// the data is reused for the placeholder
+					imgURL, imgData, width, height, err = dataFetcher.ImageData(ctx, resolvedURL)
+				} else {
+					imgURL, width, height, err = conv.ampImageStatsFetcher.ImageSize(ctx, resolvedURL)
+				}
+				if isFetchBlocked(err) {
+					conv.addAMPError(&AMPError{
+						Type:  AMPFetchBlocked,
+						token: tag,
+						cause: err,
+					})
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+
+				srcValue = imgURL.String()
+				if !conv.absoluteURL && srcValue == resolvedURL.String() {
+					// not modified by AMPImageStatsFetcher
+					srcValue = attr.Value
+				}
 			}
 
-			imgURL, width, height, err := conv.ampImageStatsFetcher.ImageSize(imgURL)
-			if err != nil {
-				return nil, err
-			}
+			altTag.AddAttr("src", srcValue)
 
-			altTag.AddAttr("src", imgURL.String())
+			conv.setMediaLayout(tag, altTag, width, height)
 
-			altTag.AddAttr("width", strconv.Itoa(width))
-			altTag.AddAttr("height", strconv.Itoa(height))
-			altTag.AddAttr("layout", "responsive")
-
-			srcset, err := conv.ampImageStatsFetcher.ImageSrcSetAttr(imgURL)
+			srcset, err := conv.ampImageStatsFetcher.ImageSrcSetAttr(ctx, imgURL)
 			if err != nil {
 				return nil, err
 			}
@@ -102,6 +188,8 @@ func ampImageModifier(conv *Converter, ampTag *AMPTag, tag html2html.Tag) (html2
 				altTag.AddAttr("srcset", srcset)
 			}
 
+			conv.addImagePlaceholder(ctx, altTag, imgURL, imgData)
+
 		default:
 			// ignore
 		}
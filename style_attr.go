@@ -0,0 +1,227 @@
+package amphtml
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type StyleClassMode int
+
+const (
+	// StyleClassPerTag makes a class per tag name and style attr, e.g. span.h2a-span-43fe289185
+	StyleClassPerTag StyleClassMode = iota
+	// StyleClassShared makes a tag-agnostic class per normalized declaration block, e.g. .h2a-5f2b1c0e9a
+	StyleClassShared
+)
+
+// the shorthand properties and their longhands, e.g. border, border-top and border-top-left-radius are in the border family.
+// the properties in the same family may set the same value, so their order matters.
+var cssPropertyFamilies = []string{
+	"animation",
+	"background",
+	"border",
+	"column",
+	"flex",
+	"font",
+	"inset",
+	"list-style",
+	"margin",
+	"outline",
+	"overflow",
+	"padding",
+	"text-decoration",
+	"transform",
+	"transition",
+}
+
+// the properties which are in the family of another name.
+var cssPropertyFamilyAliases = map[string]string{
+	"columns":     "column",
+	"line-height": "font",
+	"top":         "inset",
+	"right":       "inset",
+	"bottom":      "inset",
+	"left":        "inset",
+}
+
+// the longhands which are not set by any shorthand but themselves.
+var cssIndependentProperties = map[string]bool{
+	"box-shadow":     true,
+	"box-sizing":     true,
+	"clear":          true,
+	"color":          true,
+	"content":        true,
+	"cursor":         true,
+	"display":        true,
+	"float":          true,
+	"height":         true,
+	"letter-spacing": true,
+	"max-height":     true,
+	"max-width":      true,
+	"min-height":     true,
+	"min-width":      true,
+	"opacity":        true,
+	"position":       true,
+	"text-align":     true,
+	"text-indent":    true,
+	"text-shadow":    true,
+	"text-transform": true,
+	"vertical-align": true,
+	"visibility":     true,
+	"white-space":    true,
+	"width":          true,
+	"word-break":     true,
+	"word-spacing":   true,
+	"z-index":        true,
+}
+
+var cssVendorPrefixes = []string{"-webkit-", "-moz-", "-ms-", "-o-"}
+
+// styleAttrClass returns the class name for style attr and the rule which replaces it.
+func (conv *Converter) styleAttrClass(tagName, styleAttr string) (string, string) {
+	if conv.styleClassMode == StyleClassShared {
+		block := normalizeStyleAttr(styleAttr)
+		className := conv.styleClassPrefix + styleHash(block)
+		return className, "." + className + "{" + block + "}\n"
+	}
+
+	className := conv.styleClassPrefix + tagName + "-" + styleHash(styleAttr)
+	return className, tagName + "." + className + "{" + styleAttr + "}\n"
+}
+
+func styleHash(s string) string {
+	h := sha1.New()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))[0:10]
+}
+
+// normalizeStyleAttr makes the declaration block of style attr canonical, so the same styles get the same class.
+// property names are lower cased, comments are dropped and whitespaces are collapsed.
+// declarations are sorted by the property name only if the order doesn't matter, see cssDeclarationsSortable.
+func normalizeStyleAttr(styleAttr string) string {
+	decls := parseStyleAttr(styleAttr)
+
+	type declaration struct {
+		name  string
+		value string
+	}
+	list := make([]declaration, 0, len(decls))
+	for _, decl := range decls {
+		list = append(list, declaration{name: decl.Name(), value: normalizeCSSValue(decl.ValueTokens())})
+	}
+
+	names := make([]string, 0, len(list))
+	for _, decl := range list {
+		names = append(names, decl.name)
+	}
+	if cssDeclarationsSortable(names) {
+		// the same properties keep their order, the last one wins
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].name < list[j].name
+		})
+	}
+
+	strs := make([]string, 0, len(list))
+	for _, decl := range list {
+		strs = append(strs, decl.name+":"+decl.value)
+	}
+
+	return strings.Join(strs, ";")
+}
+
+// parseStyleAttr parses style attr as declaration list. invalid declarations are dropped.
+func parseStyleAttr(styleAttr string) []*cssDeclaration {
+	tokens, _ := tokenizeCSS(styleAttr)
+	p := &cssParser{tokens: tokens}
+	decls, _ := p.parseDeclarations(tokens)
+	return decls
+}
+
+// isFlexContainerStyle reports whether style attr makes the element a flex container.
+func isFlexContainerStyle(styleAttr string) bool {
+	flex := false
+	for _, decl := range parseStyleAttr(styleAttr) {
+		if decl.Name() != "display" {
+			continue
+		}
+		// the last one wins
+		switch strings.ToLower(normalizeCSSValue(decl.ValueTokens())) {
+		case "flex", "inline-flex", "-webkit-flex", "-webkit-inline-flex":
+			flex = true
+		default:
+			flex = false
+		}
+	}
+
+	return flex
+}
+
+// normalizeCSSValue drops comments and collapses whitespaces.
+func normalizeCSSValue(tokens []cssToken) string {
+	var buf strings.Builder
+	space := false
+	for _, token := range tokens {
+		switch token.Type {
+		case cssTokenComment:
+			continue
+		case cssTokenWhitespace:
+			space = true
+			continue
+		}
+		if space && buf.Len() != 0 {
+			buf.WriteString(" ")
+		}
+		space = false
+		buf.WriteString(token.Raw)
+	}
+
+	return buf.String()
+}
+
+// cssDeclarationsSortable reports whether the declarations can be reordered without changing the result.
+// all properties must be known, and no two of them may be in the same family, e.g. margin and margin-top, or vendor prefixed ones.
+// the same property may appear twice, it is sorted stably.
+func cssDeclarationsSortable(names []string) bool {
+	families := make(map[string]string)
+	for _, name := range names {
+		family, ok := cssPropertyFamily(name)
+		if !ok {
+			return false
+		}
+		if other, ok := families[family]; ok && other != name {
+			return false
+		}
+		families[family] = name
+	}
+
+	return true
+}
+
+// cssPropertyFamily returns the family of the property. it returns false for the unknown property.
+func cssPropertyFamily(name string) (string, bool) {
+	name = trimCSSVendorPrefix(name)
+	if family, ok := cssPropertyFamilyAliases[name]; ok {
+		return family, true
+	}
+	for _, family := range cssPropertyFamilies {
+		if name == family || strings.HasPrefix(name, family+"-") {
+			return family, true
+		}
+	}
+	if cssIndependentProperties[name] {
+		return name, true
+	}
+
+	return "", false
+}
+
+func trimCSSVendorPrefix(name string) string {
+	for _, prefix := range cssVendorPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return name[len(prefix):]
+		}
+	}
+	return name
+}
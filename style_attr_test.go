@@ -0,0 +1,85 @@
+package amphtml
+
+import "testing"
+
+func TestNormalizeStyleAttr(t *testing.T) {
+	specs := []struct {
+		style    string
+		expected string
+	}{
+		{"color: red", "color:red"},
+		{" COLOR : red ; ", "color:red"},
+		{"margin: 0  auto; color: red;", "color:red;margin:0 auto"},
+		{"color: red; /* note */ font-size: 12px", "color:red;font-size:12px"},
+		{"font-family: 'Open  Sans', serif", "font-family:'Open  Sans', serif"},
+		{"color: red; background: blue; color: green", "background:blue;color:red;color:green"},
+		// the order matters
+		{"margin: 0; color: red; margin-top: 5px", "margin:0;color:red;margin-top:5px"},
+		{"line-height: 2; font: 12px serif", "line-height:2;font:12px serif"},
+		{"transform: none; -webkit-transform: none", "transform:none;-webkit-transform:none"},
+		{"border-top-left-radius: 0; border-radius: 4px", "border-top-left-radius:0;border-radius:4px"},
+		{"border-top: 1px solid; border-color: red", "border-top:1px solid;border-color:red"},
+		{"flex-flow: row; flex-direction: column", "flex-flow:row;flex-direction:column"},
+		{"columns: 2; column-count: 3", "columns:2;column-count:3"},
+		{"list-style: none; list-style-type: disc", "list-style:none;list-style-type:disc"},
+		{"top: 0; inset: auto", "top:0;inset:auto"},
+		// unknown properties may overlap with the others
+		{"width: 10px; color: red; grid-area: a", "width:10px;color:red;grid-area:a"},
+		// broken declaration is dropped
+		{"color red; width: 10px", "width:10px"},
+	}
+	for _, spec := range specs {
+		if v := normalizeStyleAttr(spec.style); v != spec.expected {
+			t.Errorf("unexpected, expected: %q, actual: %q", spec.expected, v)
+		}
+	}
+}
+
+func TestStyleAttrClass(t *testing.T) {
+	conv := &Converter{styleClassPrefix: "h2a-"}
+	className, rule := conv.styleAttrClass("span", "color: red")
+	if className != "h2a-span-43fe289185" {
+		t.Error("unexpected", className)
+	}
+	if rule != "span.h2a-span-43fe289185{color: red}\n" {
+		t.Error("unexpected", rule)
+	}
+
+	conv = &Converter{styleClassMode: StyleClassShared, styleClassPrefix: "s-"}
+	className, rule = conv.styleAttrClass("span", "color: red; margin: 0")
+	otherClassName, _ := conv.styleAttrClass("div", "margin:0;color:red;")
+	if className != otherClassName {
+		t.Error("unexpected", className, otherClassName)
+	}
+	if rule != "."+className+"{color:red;margin:0}\n" {
+		t.Error("unexpected", rule)
+	}
+	if className[:2] != "s-" || len(className) != 12 {
+		t.Error("unexpected", className)
+	}
+
+	// the order matters, they are different
+	className, _ = conv.styleAttrClass("span", "border-top-left-radius:0;border-radius:4px")
+	otherClassName, _ = conv.styleAttrClass("span", "border-radius:4px;border-top-left-radius:0")
+	if className == otherClassName {
+		t.Error("unexpected", className)
+	}
+}
+
+func TestIsFlexContainerStyle(t *testing.T) {
+	specs := []struct {
+		style    string
+		expected bool
+	}{
+		{"display: flex", true},
+		{"color: red; DISPLAY: Inline-Flex", true},
+		{"display: flex; display: block", false},
+		{"display: block", false},
+		{"flex: 1", false},
+	}
+	for _, spec := range specs {
+		if v := isFlexContainerStyle(spec.style); v != spec.expected {
+			t.Error(spec.style, "unexpected", v)
+		}
+	}
+}
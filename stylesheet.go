@@ -0,0 +1,435 @@
+package amphtml
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/favclip/ampassador/amppb"
+	"github.com/favclip/html2html"
+	"github.com/tdewolff/minify"
+	"github.com/tdewolff/minify/css"
+)
+
+var _ error = &StyleSheetTooLongError{}
+
+// StyleSheetTooLongError is the cause of STYLESHEET_TOO_LONG error.
+// Sources reports the size of each stylesheet after pruning and minifying.
+type StyleSheetTooLongError struct {
+	Size     int
+	MaxBytes int
+	Sources  []*StyleSheetSize
+}
+
+type StyleSheetSize struct {
+	Source string
+	Bytes  int
+}
+
+func (e *StyleSheetTooLongError) Error() string {
+	var sizes []string
+	for _, source := range e.Sources {
+		sizes = append(sizes, fmt.Sprintf("%s %d bytes", source.Source, source.Bytes))
+	}
+	return fmt.Sprintf("stylesheet is %d bytes, exceeds %d bytes: %s", e.Size, e.MaxBytes, strings.Join(sizes, ", "))
+}
+
+type StyleSheetType int
+
+const (
+	StyleSheetLink StyleSheetType = iota + 1
+	StyleSheetEmbed
+	StyleSheetAttr
+)
+
+// StyleSheet is the css extracted from <link>, <style> or style attr.
+type StyleSheet struct {
+	Type    StyleSheetType
+	Source  string // href of <link>, or the class name generated for style attr
+	Content string
+}
+
+// StyleSheets is the list of StyleSheet in document order.
+type StyleSheets []*StyleSheet
+
+// sourceName returns the name used in the size breakdown. style tags and style attrs are summed up.
+func (s *StyleSheet) sourceName() string {
+	switch s.Type {
+	case StyleSheetLink:
+		return s.Source
+	case StyleSheetEmbed:
+		return "style tag"
+	case StyleSheetAttr:
+		return "style attributes"
+	}
+
+	return "unknown"
+}
+
+// attrLast moves the style attrs after the other stylesheets, keeping the order in each.
+func (s StyleSheets) attrLast() StyleSheets {
+	sorted := make(StyleSheets, 0, len(s))
+	for _, styleSheet := range s {
+		if styleSheet.Type != StyleSheetAttr {
+			sorted = append(sorted, styleSheet)
+		}
+	}
+	for _, styleSheet := range s {
+		if styleSheet.Type == StyleSheetAttr {
+			sorted = append(sorted, styleSheet)
+		}
+	}
+	return sorted
+}
+
+// buildAMPCustomCSS makes the content of <style amp-custom> from sources.
+// the rules made from style attrs are placed last and boosted to the highest specificity in the other rules,
+// so they keep winning like inline styles.
+// when it exceeds the size limit, it is minified and the rules which can't match to the elements in rootTag are pruned.
+func (conv *Converter) buildAMPCustomCSS(rootTag html2html.Tag, sources StyleSheets) (string, error) {
+	tagSpec := conv.ampValidatorRules.findAMPCustomStyleSpec()
+	maxBytes := int(tagSpec.GetCdata().GetMaxBytes())
+
+	sources = sources.attrLast()
+	sheets := make([]*cssStylesheet, 0, len(sources))
+	var maxSpecificity cssSpecificity
+	for _, source := range sources {
+		sheet, err := conv.validateAMPCustomCSS(source.Content)
+		if err != nil {
+			return "", err
+		}
+		if source.Type == StyleSheetAttr {
+			boostCSSSpecificity(sheet.Rules, maxSpecificity)
+		} else if s := maxCSSSpecificity(sheet.Rules); maxSpecificity.less(s) {
+			maxSpecificity = s
+		}
+		sheets = append(sheets, sheet)
+	}
+
+	styleString := joinCSSStylesheets(sheets)
+	if maxBytes < 0 || len(styleString) <= maxBytes {
+		return styleString, nil
+	}
+
+	minified, err := minifyCSS(styleString)
+	if err != nil {
+		return "", err
+	}
+	if len(minified) <= maxBytes {
+		return minified, nil
+	}
+
+	if rootTag != nil {
+		index := newCSSDocumentIndex(rootTag)
+		for _, sheet := range sheets {
+			sheet.Rules = pruneCSSRules(sheet.Rules, index)
+		}
+		minified, err = minifyCSS(joinCSSStylesheets(sheets))
+		if err != nil {
+			return "", err
+		}
+		if len(minified) <= maxBytes {
+			return minified, nil
+		}
+	}
+
+	tooLongErr := &StyleSheetTooLongError{
+		Size:     len(minified),
+		MaxBytes: maxBytes,
+	}
+	sizes := make(map[string]*StyleSheetSize)
+	for i, sheet := range sheets {
+		sourceMinified, err := minifyCSS(sheet.String())
+		if err != nil {
+			return "", err
+		}
+		name := sources[i].sourceName()
+		if size := sizes[name]; size != nil {
+			size.Bytes += len(sourceMinified)
+			continue
+		}
+		size := &StyleSheetSize{Source: name, Bytes: len(sourceMinified)}
+		sizes[name] = size
+		tooLongErr.Sources = append(tooLongErr.Sources, size)
+	}
+	conv.addAMPError(&AMPError{
+		Type:                AMPValidatorError,
+		Code:                amppb.ValidationError_STYLESHEET_TOO_LONG,
+		validatorSourceSpec: tagSpec,
+		cause:               tooLongErr,
+	})
+
+	return minified, nil
+}
+
+// validateAMPCustomCSS parses the css for <style amp-custom> and drops the constructs disallowed by its CdataSpec.
+// each dropped or rewritten construct is reported as AMPRemoveCSS.
+func (conv *Converter) validateAMPCustomCSS(content string) (*cssStylesheet, error) {
+	tagSpec := conv.ampValidatorRules.findAMPCustomStyleSpec()
+
+	sheet, errs := parseCSS(content)
+
+	var filterErrs []*cssError
+	sheet.Rules, filterErrs = filterCSSRules(sheet.Rules, tagSpec.GetCdata().GetCssSpec())
+	errs = append(errs, filterErrs...)
+	errs = append(errs, checkCSSURLs(sheet.Rules, tagSpec.GetCdata().GetCssSpec())...)
+
+	sanitizeErrs, err := sanitizeCSS(sheet, tagSpec.GetCdata())
+	if err != nil {
+		return nil, err
+	}
+	errs = append(errs, sanitizeErrs...)
+
+	// each source is parsed separately, the block reached EOF must not swallow the next source
+	sheet.closeBlocks()
+
+	for _, cssErr := range errs {
+		conv.addAMPError(&AMPError{
+			Type:                AMPRemoveCSS,
+			Code:                cssErr.Code,
+			validatorSourceSpec: tagSpec,
+			cause:               cssErr,
+		})
+	}
+
+	return sheet, nil
+}
+
+func joinCSSStylesheets(sheets []*cssStylesheet) string {
+	var buf strings.Builder
+	for _, sheet := range sheets {
+		content := sheet.String()
+		if content == "" {
+			continue
+		}
+		buf.WriteString(content)
+		if !strings.HasSuffix(content, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+func minifyCSS(content string) (string, error) {
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	return m.String("text/css", content)
+}
+
+// styleSheetMedia returns the media attr of <link> or <style>. empty means all media.
+// ok is false when the stylesheet should be dropped, the media query is broken or it is only for print.
+// the broken media query is reported as AMPRemoveCSS.
+func (conv *Converter) styleSheetMedia(tag html2html.Tag) (string, bool) {
+	mediaAttr := tag.GetAttr("media")
+	if mediaAttr == nil {
+		return "", true
+	}
+
+	media, ok := normalizeCSSMedia(mediaAttr.Value)
+	if !ok {
+		// the browser never applies the stylesheet
+		name := "style tag"
+		if hrefAttr := tag.GetAttr("href"); hrefAttr != nil {
+			name = hrefAttr.Value
+		}
+		conv.addAMPError(&AMPError{
+			Type:  AMPRemoveCSS,
+			Code:  amppb.ValidationError_CSS_SYNTAX,
+			token: tag,
+			cause: fmt.Errorf("%s: invalid media query %q, the stylesheet is dropped", name, mediaAttr.Value),
+		})
+		return "", false
+	}
+	if conv.dropPrintStyleSheets && isPrintOnlyCSSMedia(media) {
+		return "", false
+	}
+
+	return media, true
+}
+
+// normalizeCSSMedia trims the media query list and returns empty for all media.
+// ok is false if media can't be placed in @media prelude.
+func normalizeCSSMedia(media string) (string, bool) {
+	media = strings.TrimSpace(media)
+	if media == "" || strings.EqualFold(media, "all") {
+		return "", true
+	}
+
+	tokens, errs := tokenizeCSS(media)
+	if len(errs) != 0 {
+		return "", false
+	}
+	for _, token := range tokens {
+		switch token.Type {
+		case cssTokenOpenCurly, cssTokenCloseCurly, cssTokenSemicolon, cssTokenAtKeyword, cssTokenCDO, cssTokenCDC:
+			return "", false
+		}
+	}
+
+	return media, true
+}
+
+// isPrintOnlyCSSMedia reports whether every query in the media query list is for print.
+func isPrintOnlyCSSMedia(media string) bool {
+	if media == "" {
+		return false
+	}
+	for _, query := range strings.Split(media, ",") {
+		fields := strings.Fields(strings.ToLower(query))
+		if len(fields) != 0 && fields[0] == "only" {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || fields[0] != "print" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// wrapCSSMedia wraps content by @media rule.
+func wrapCSSMedia(content, media string) string {
+	if media == "" {
+		return content
+	}
+	return "@media " + media + "{\n" + content + "\n}\n"
+}
+
+// fetchStyleSheet fetches the stylesheet, and rebases url() in it against styleSheetURL.
+// url() in the stylesheet is relative to the stylesheet, not to the document.
+func (conv *Converter) fetchStyleSheet(ctx context.Context, styleSheetURL *url.URL) (string, error) {
+	f, err := conv.fileFetcher(ctx, styleSheetURL)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	return rebaseCSSURLs(string(b), styleSheetURL), nil
+}
+
+// inlineCSSImports replaces @import rules at the top of content by the imported stylesheets recursively.
+// ancestors are the URLs of the importing stylesheets, it is used to detect cycles.
+func (conv *Converter) inlineCSSImports(ctx context.Context, content string, styleSheetURL *url.URL, ancestors []string) (string, error) {
+	sheet, _ := parseCSS(content)
+
+	hasImport := false
+	for _, rule := range sheet.Rules {
+		if rule.AtKeyword == "import" {
+			hasImport = true
+			break
+		}
+	}
+	if !hasImport {
+		return content, nil
+	}
+
+	var buf strings.Builder
+	imports := true
+	for _, rule := range sheet.Rules {
+		// @import after the other rules is ignored by browsers, it will be dropped as invalid at-rule.
+		if rule.AtKeyword != "import" || !imports {
+			if rule.AtKeyword != "charset" {
+				imports = false
+			}
+			rule.writeTo(&buf)
+			continue
+		}
+
+		ref, media, ok := parseCSSImportPrelude(rule.Prelude[1:])
+		if !ok {
+			rule.writeTo(&buf)
+			continue
+		}
+		buf.WriteString(rule.Leading)
+
+		importURL, err := resolveURLReference(styleSheetURL, ref)
+		if err != nil {
+			return "", err
+		}
+		rawMedia := media
+		if media, ok = normalizeCSSMedia(rawMedia); !ok {
+			// the browser never applies the stylesheet
+			conv.addAMPError(&AMPError{
+				Type:  AMPRemoveCSS,
+				Code:  amppb.ValidationError_CSS_SYNTAX,
+				cause: fmt.Errorf("@import %s: invalid media query %q, the stylesheet is dropped", importURL, rawMedia),
+			})
+			continue
+		}
+
+		cycle := false
+		for _, ancestor := range ancestors {
+			if ancestor == importURL.String() {
+				cycle = true
+				break
+			}
+		}
+		if cycle {
+			conv.addAMPError(&AMPError{
+				Type:  AMPRemoveCSS,
+				Code:  amppb.ValidationError_CSS_SYNTAX_INVALID_AT_RULE,
+				cause: fmt.Errorf("@import %s: circular import", importURL),
+			})
+			continue
+		}
+
+		imported, err := conv.fetchStyleSheet(ctx, importURL)
+		if isFetchBlocked(err) {
+			conv.addAMPError(&AMPError{
+				Type:  AMPFetchBlocked,
+				cause: err,
+			})
+			continue
+		} else if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", ctxErr
+		} else if err != nil {
+			// the imported stylesheet is optional, unlike <link>
+			conv.addAMPError(&AMPError{
+				Type:  AMPRemoveCSS,
+				Code:  amppb.ValidationError_CSS_SYNTAX_INVALID_AT_RULE,
+				cause: fmt.Errorf("@import %s: %v", importURL, err),
+			})
+			continue
+		}
+		imported, err = conv.inlineCSSImports(ctx, imported, importURL, append(ancestors[:len(ancestors):len(ancestors)], importURL.String()))
+		if err != nil {
+			return "", err
+		}
+
+		if conv.debug {
+			buf.WriteString(fmt.Sprintf("/* from %s */\n", importURL))
+		}
+		imported = wrapCSSMedia(imported, media)
+		buf.WriteString(imported)
+		if !strings.HasSuffix(imported, "\n") {
+			buf.WriteString("\n")
+		}
+	}
+	buf.WriteString(sheet.Trailing)
+
+	return buf.String(), nil
+}
+
+// parseCSSImportPrelude reads the URL and the media query list from the prelude of @import.
+func parseCSSImportPrelude(prelude []cssToken) (string, string, bool) {
+	prelude = trimCSSTrivia(prelude)
+	if len(prelude) == 0 {
+		return "", "", false
+	}
+
+	if prelude[0].Type == cssTokenString {
+		return prelude[0].Value, cssTokensString(prelude[1:]), true
+	}
+	ref, _, end, ok := cssURLAt(prelude, 0)
+	if !ok {
+		return "", "", false
+	}
+
+	return ref, cssTokensString(prelude[end:]), true
+}
@@ -0,0 +1,248 @@
+package amphtml
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/favclip/ampassador/amppb"
+	"github.com/favclip/html2html"
+)
+
+func TestNormalizeCSSMedia(t *testing.T) {
+	specs := []struct {
+		media    string
+		expected string
+		ok       bool
+	}{
+		{"", "", true},
+		{" all ", "", true},
+		{"print", "print", true},
+		{" (min-width: 768px) ", "(min-width: 768px)", true},
+		{"screen and (max-width: 480px), print", "screen and (max-width: 480px), print", true},
+		{"screen{} .a{color:red}", "", false},
+		{"screen; @import", "", false},
+	}
+	for _, spec := range specs {
+		media, ok := normalizeCSSMedia(spec.media)
+		if media != spec.expected || ok != spec.ok {
+			t.Error(spec.media, "unexpected", media, ok)
+		}
+	}
+}
+
+func TestConverter_styleSheetMedia(t *testing.T) {
+	conv := &Converter{dropPrintStyleSheets: true}
+
+	tag := html2html.CreateElement("link")
+	tag.AddAttr("href", "a.css")
+	tag.AddAttr("media", "screen{} .a{color:red}")
+	if _, ok := conv.styleSheetMedia(tag); ok {
+		t.Error("the stylesheet with the invalid media query must be dropped")
+	}
+	if len(conv.ampErrors) != 1 || conv.ampErrors[0].Code != amppb.ValidationError_CSS_SYNTAX || !strings.Contains(conv.ampErrors[0].Error(), "a.css") {
+		t.Error("unexpected", conv.ampErrors)
+	}
+
+	// dropped by the option, not an error
+	conv.ampErrors = nil
+	tag = html2html.CreateElement("style")
+	tag.AddAttr("media", "print")
+	if _, ok := conv.styleSheetMedia(tag); ok {
+		t.Error("the print stylesheet must be dropped")
+	}
+	if len(conv.ampErrors) != 0 {
+		t.Error("unexpected", conv.ampErrors)
+	}
+}
+
+func TestIsPrintOnlyCSSMedia(t *testing.T) {
+	specs := []struct {
+		media    string
+		expected bool
+	}{
+		{"", false},
+		{"print", true},
+		{"only print", true},
+		{"PRINT and (orientation: landscape), print", true},
+		{"print, screen", false},
+		{"(min-width: 768px)", false},
+	}
+	for _, spec := range specs {
+		if v := isPrintOnlyCSSMedia(spec.media); v != spec.expected {
+			t.Error(spec.media, "unexpected", v)
+		}
+	}
+}
+
+func TestWrapCSSMedia(t *testing.T) {
+	if v := wrapCSSMedia(".a { color: red }", ""); v != ".a { color: red }" {
+		t.Error("unexpected", v)
+	}
+	if v := wrapCSSMedia(".a { color: red }", "print"); v != "@media print{\n.a { color: red }\n}\n" {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestInlineCSSImports(t *testing.T) {
+	fsys := fstest.MapFS{
+		"b.css": {Data: []byte(`@import "a.css";` + "\n.b{color:red}")},
+		"c.css": {Data: []byte(".c{background:url(img/c.png)}")},
+	}
+	conv, err := NewConverter(
+		WithCanonicalURL("https://example.com/"),
+		WithFileFetcher(FSFileFetcher(fsys, map[string]string{"example.com": "."})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	styleSheetURL, _ := url.Parse("https://example.com/a.css")
+	content := "@import url(b.css) screen;\n@import 'css/../c.css';\n@import 'c.css' screen @media;\n.a{color:blue}\n@import 'c.css';"
+	v, err := conv.inlineCSSImports(context.Background(), content, styleSheetURL, []string{styleSheetURL.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "/* from https://example.com/b.css */\n@media screen{\n\n.b{color:red}\n}\n" +
+		"\n/* from https://example.com/c.css */\n.c{background:url(https://example.com/img/c.png)}\n" +
+		"\n\n.a{color:blue}\n@import 'c.css';"
+	if v != expected {
+		t.Errorf("unexpected, expected: %q, actual: %q", expected, v)
+	}
+
+	// a.css -> b.css -> a.css, and the invalid media query
+	if len(conv.ampErrors) != 2 || conv.ampErrors[0].Type != AMPRemoveCSS {
+		t.Error("unexpected", conv.ampErrors)
+	}
+	if v := conv.ampErrors[1]; v.Type != AMPRemoveCSS || v.Code != amppb.ValidationError_CSS_SYNTAX || !strings.Contains(v.Error(), "https://example.com/c.css") {
+		t.Error("unexpected", v)
+	}
+}
+
+func TestInlineCSSImportsInStyleTag(t *testing.T) {
+	fsys := fstest.MapFS{
+		"example.com/blog/c.css": {Data: []byte(".c{background:url(img/c.png)}")},
+	}
+	conv, err := NewConverter(
+		WithCanonicalURL("https://example.com/foo/bar"),
+		WithFileFetcher(FSFileFetcher(fsys, map[string]string{"example.com": "example.com"})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// @import and url() in the style tag are relative to <base href>, not to the canonical URL
+	tag, err := html2html.NewConverter().Parse(strings.NewReader(`<!DOCTYPE html><html><head><base href="/blog/"><style>@import "c.css";
+.a{background:url(a.png)}</style></head><body></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, styleSheets, err := conv.ReplaceToAMPTag(context.Background(), tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	styleString, err := conv.buildAMPCustomCSS(nil, styleSheets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{".c{background:url(https://example.com/blog/img/c.png)}", ".a{background:url(https://example.com/blog/a.png)}"} {
+		if !strings.Contains(styleString, expected) {
+			t.Errorf("unexpected, expected: %q, actual: %q", expected, styleString)
+		}
+	}
+	for _, ampError := range conv.ampErrors {
+		if ampError.Type == AMPRemoveCSS {
+			t.Error("unexpected", ampError)
+		}
+	}
+}
+
+func TestBuildAMPCustomCSSStyleAttrPrecedence(t *testing.T) {
+	conv, err := NewConverter(WithFileFetcher(FSFileFetcher(fstest.MapFS{}, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources := StyleSheets{
+		{Type: StyleSheetEmbed, Content: ".a span { color: blue }\n"},
+		{Type: StyleSheetAttr, Source: "h2a-span-43fe289185", Content: "span.h2a-span-43fe289185{color: red}\n"},
+		{Type: StyleSheetEmbed, Content: "#main span { color: green }\n"},
+	}
+	styleString, err := conv.buildAMPCustomCSS(nil, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ".a span { color: blue }\n#main span { color: green }\nspan.h2a-span-43fe289185:not(#h2a-span-43fe289185-id){color: red}\n"
+	if styleString != expected {
+		t.Errorf("unexpected, expected: %q, actual: %q", expected, styleString)
+	}
+}
+
+func TestConverter_styleSheetsInDocumentOrder(t *testing.T) {
+	ffOpt := WithFileFetcher(FSFileFetcher(fstest.MapFS{
+		"a.css": {Data: []byte(".a { color: red }")},
+		"c.css": {Data: []byte(".c { color: green }")},
+	}, map[string]string{"example.com/foo/": "."}))
+	src := `<!DOCTYPE html><html><head>
+<link rel="stylesheet" href="a.css">
+<style>.b { color: blue }</style>
+<link rel="stylesheet" href="c.css">
+</head><body>
+<div style="color: red">1</div>
+<style>.d { color: gray }</style>
+<span style="color: blue">2</span>
+</body></html>`
+
+	var first string
+	for i := 0; i < 10; i++ {
+		conv, err := NewConverter(WithCanonicalURL("https://example.com/foo/bar"), ffOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, err := html2html.NewConverter().Parse(strings.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, styleSheets, err := conv.ReplaceToAMPTag(context.Background(), tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var types []StyleSheetType
+		for _, styleSheet := range styleSheets {
+			types = append(types, styleSheet.Type)
+		}
+		expectedTypes := []StyleSheetType{StyleSheetLink, StyleSheetEmbed, StyleSheetLink, StyleSheetAttr, StyleSheetEmbed, StyleSheetAttr}
+		if !reflect.DeepEqual(types, expectedTypes) {
+			t.Fatal("unexpected", types)
+		}
+
+		style, err := conv.StyleToAMPCustomTag(tag, styleSheets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBufferString("")
+		style.BuildHTML(buf)
+		if i == 0 {
+			first = buf.String()
+		} else if v := buf.String(); v != first {
+			t.Fatalf("output is changed, expected: %q, actual: %q", first, v)
+		}
+	}
+
+	// the style attrs come last to keep their precedence, in document order too
+	last := -1
+	for _, s := range []string{".a {", ".b {", ".c {", ".d {", "div.h2a-div-", "span.h2a-span-"} {
+		i := strings.Index(first, s)
+		if i <= last {
+			t.Fatalf("%s is out of order: %q", s, first)
+		}
+		last = i
+	}
+}
@@ -0,0 +1,113 @@
+package amphtml
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/favclip/html2html"
+)
+
+// documentBaseURL returns the base URL of the document.
+// It is the canonical URL, and overridden by the first <base href> element.
+func (conv *Converter) documentBaseURL(rootTag html2html.Tag) (*url.URL, error) {
+	docURL, err := url.Parse(conv.canonicalURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, baseTag := range rootTag.GetElementsByTagName("base") {
+		hrefAttr := baseTag.GetAttr("href")
+		if hrefAttr == nil {
+			continue
+		}
+
+		baseURL, err := url.Parse(strings.TrimSpace(hrefAttr.Value))
+		if err != nil {
+			return nil, err
+		}
+
+		return docURL.ResolveReference(baseURL), nil
+	}
+
+	return docURL, nil
+}
+
+// resolveURL resolves ref against the document base URL by RFC 3986.
+func (conv *Converter) resolveURL(ref string) (*url.URL, error) {
+	return resolveURLReference(conv.baseURL, ref)
+}
+
+func resolveURLReference(base *url.URL, ref string) (*url.URL, error) {
+	refURL, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return nil, err
+	}
+	if base == nil {
+		return refURL, nil
+	}
+
+	return base.ResolveReference(refURL), nil
+}
+
+// isRebasableURL reports whether ref is relative and points to another resource.
+// fragment only references (e.g. #top) and references with a scheme are kept as is.
+func isRebasableURL(ref string) bool {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return false
+	}
+
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+
+	return refURL.Scheme == ""
+}
+
+// rebaseCSSURLs rewrites relative url() references in the stylesheet to absolute URLs against base.
+// url() in comments and strings are kept as is.
+func rebaseCSSURLs(content string, base *url.URL) string {
+	if base == nil {
+		return content
+	}
+
+	return rewriteCSSURLs(content, func(ref string) (string, bool) {
+		if !isRebasableURL(ref) {
+			return "", false
+		}
+		refURL, err := resolveURLReference(base, ref)
+		if err != nil {
+			return "", false
+		}
+
+		return refURL.String(), true
+	})
+}
+
+// absolutizeURLAttrs rewrites relative src and href attributes to absolute URLs.
+// AMP caches serve the document from another origin, relative URLs will be broken.
+func (conv *Converter) absolutizeURLAttrs(tag html2html.Tag) {
+	if !conv.absoluteURL {
+		return
+	}
+	if tag.Name() == "base" {
+		// <base href> is the origin of the resolution
+		return
+	}
+
+	for _, attr := range tag.Attrs() {
+		if attr.Key != "src" && attr.Key != "href" {
+			continue
+		}
+		if !isRebasableURL(attr.Value) {
+			continue
+		}
+
+		attrURL, err := conv.resolveURL(attr.Value)
+		if err != nil {
+			continue
+		}
+		attr.Value = attrURL.String()
+	}
+}
@@ -0,0 +1,151 @@
+package amphtml
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/favclip/html2html"
+)
+
+func TestResolveURLReference(t *testing.T) {
+	base, _ := url.Parse("https://example.com/foo/bar")
+
+	specs := []struct {
+		ref      string
+		expected string
+	}{
+		{"./style.css", "https://example.com/foo/style.css"},
+		{"style.css", "https://example.com/foo/style.css"},
+		{"../img/cat.jpg", "https://example.com/img/cat.jpg"},
+		{"/cat.jpg", "https://example.com/cat.jpg"},
+		{"//cdn.example.com/cat.jpg", "https://cdn.example.com/cat.jpg"},
+		{"?page=2", "https://example.com/foo/bar?page=2"},
+		{"https://example.org/", "https://example.org/"},
+	}
+	for _, spec := range specs {
+		resolved, err := resolveURLReference(base, spec.ref)
+		if err != nil {
+			t.Fatal(spec.ref, err)
+		}
+		if v := resolved.String(); v != spec.expected {
+			t.Error(spec.ref, "unexpected", v)
+		}
+	}
+
+	if v := base.String(); v != "https://example.com/foo/bar" {
+		t.Error("base is modified", v)
+	}
+}
+
+func TestRebaseCSSURLs(t *testing.T) {
+	base, _ := url.Parse("https://example.com/css/style.css")
+
+	specs := []struct {
+		content  string
+		expected string
+	}{
+		{`a{background:url(../img/a.png)}`, `a{background:url(https://example.com/img/a.png)}`},
+		{`a{background:url( "b.png" )}`, `a{background:url("https://example.com/css/b.png")}`},
+		{`a{background:URL('/c.png')}`, `a{background:url('https://example.com/c.png')}`},
+		{`a{background:url(data:image/png;base64,AAAA)}`, `a{background:url(data:image/png;base64,AAAA)}`},
+		{`a{filter:url(#blur)}`, `a{filter:url(#blur)}`},
+		{`a{background:url(https://example.org/d.png)}`, `a{background:url(https://example.org/d.png)}`},
+		{`a{content:"url(e.png)"}/* url(f.png) */`, `a{content:"url(e.png)"}/* url(f.png) */`},
+		{`@import "g.css";`, `@import "g.css";`},
+	}
+	for _, spec := range specs {
+		if v := rebaseCSSURLs(spec.content, base); v != spec.expected {
+			t.Error(spec.content, "unexpected", v)
+		}
+	}
+}
+
+func TestConverter_ReplaceToAMPTagURLs(t *testing.T) {
+	// the files are served at their resolved URLs only
+	ffOpt := WithFileFetcher(FSFileFetcher(fstest.MapFS{
+		"example.com/css/a.css":  {Data: []byte(".a { background: url(a.png) }")},
+		"example.com/blog/b.css": {Data: []byte(".b { color: red }")},
+		"cdn.example.com/c.css":  {Data: []byte(".c { color: blue }")},
+	}, map[string]string{
+		"example.com":     "example.com",
+		"cdn.example.com": "cdn.example.com",
+	}))
+
+	specs := []struct {
+		head     string
+		expected string
+	}{
+		{`<link rel="stylesheet" href="../css/a.css">`, ".a { background: url(https://example.com/css/a.png) }"},
+		{`<base href="/blog/"><link rel="stylesheet" href="b.css">`, ".b { color: red }"},
+		{`<base href="https://example.com/blog/"><link rel="stylesheet" href="./b.css">`, ".b { color: red }"},
+		{`<link rel="stylesheet" href="//cdn.example.com/c.css">`, ".c { color: blue }"},
+		{`<style>.d { background: url(../img/d.png) }</style>`, ".d { background: url(https://example.com/img/d.png) }"},
+		{`<base href="/blog/"><style>.e { background: url(e.png) }</style>`, ".e { background: url(https://example.com/blog/e.png) }"},
+	}
+	for _, spec := range specs {
+		tag, err := html2html.NewConverter().Parse(strings.NewReader("<!DOCTYPE html><html><head>" + spec.head + "</head><body></body></html>"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conv, err := NewConverter(WithCanonicalURL("https://example.com/foo/bar"), ffOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, styleSheets, err := conv.ReplaceToAMPTag(context.Background(), tag)
+		if err != nil {
+			t.Error(spec.head, err)
+			continue
+		}
+		if len(styleSheets) != 1 || !strings.Contains(styleSheets[0].Content, spec.expected) {
+			t.Error(spec.head, "unexpected", styleSheets)
+		}
+	}
+}
+
+func TestConverter_isFontProviderStyleSheet(t *testing.T) {
+	ffOpt := WithFileFetcher(FSFileFetcher(fstest.MapFS{
+		"fonts.googleapis.com/css": {Data: []byte(".f { font-family: Roboto }")},
+	}, map[string]string{"fonts.googleapis.com": "fonts.googleapis.com"}))
+
+	specs := []struct {
+		href   string
+		inline bool
+	}{
+		{"https://fonts.googleapis.com/css?family=Roboto", false},
+		// not allowed as <link> by the validator, it is inlined
+		{"//fonts.googleapis.com/css?family=Roboto", true},
+	}
+	for _, spec := range specs {
+		conv, err := NewConverter(WithCanonicalURL("https://example.com/foo/bar"), ffOpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, err := html2html.NewConverter().Parse(strings.NewReader(`<!DOCTYPE html><html><head><link rel="stylesheet" href="` + spec.href + `"></head><body></body></html>`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tag, styleSheets, err := conv.ReplaceToAMPTag(context.Background(), tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spec.inline {
+			if len(styleSheets) != 1 || len(tag.GetElementsByTagName("link")) != 0 {
+				t.Error(spec.href, "unexpected", styleSheets)
+			}
+			continue
+		}
+		if len(styleSheets) != 0 {
+			t.Error(spec.href, "unexpected", styleSheets)
+		}
+		// the href is kept as authored
+		links := tag.GetElementsByTagName("link")
+		if len(links) != 1 || !links[0].HasAttrValue("href", spec.href) {
+			t.Error(spec.href, "unexpected", links)
+		}
+	}
+}